@@ -0,0 +1,153 @@
+package services
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"github.com/kylelemons/go-rpcgen/services/wire"
+)
+
+// Content types understood by the built-in Codecs.
+const (
+	ProtoContentType = "application/proto-rpc"
+	JSONContentType  = "application/json-rpc"
+	GRPCContentType  = "application/grpc"
+)
+
+// Codec names an RPC wire format by content type and knows how to build the
+// rpc.ClientCodec/rpc.ServerCodec that speak it.  Register additional codecs
+// with RegisterCodec so NegotiateServerCodec can recognize them.
+type Codec struct {
+	// ContentType identifies this Codec during negotiation.
+	ContentType string
+
+	// NewClientCodec builds a client-side codec that communicates over conn.
+	NewClientCodec func(conn net.Conn, limits Limits) rpc.ClientCodec
+
+	// NewServerCodec builds a server-side codec reading from r (which may
+	// already have buffered bytes consumed by negotiation) and writing to
+	// and closing through w.
+	NewServerCodec func(r *bufio.Reader, w io.WriteCloser, limits Limits) rpc.ServerCodec
+}
+
+var codecsByContentType = map[string]Codec{}
+
+// RegisterCodec makes a Codec available to NegotiateServerCodec under its
+// ContentType.  It is intended to be called from init().
+func RegisterCodec(c Codec) {
+	codecsByContentType[c.ContentType] = c
+}
+
+// CodecByContentType returns the Codec registered for contentType, if any.
+func CodecByContentType(contentType string) (Codec, bool) {
+	c, ok := codecsByContentType[contentType]
+	return c, ok
+}
+
+// ProtoCodec is the original go-rpcgen wire format: a wire.Header followed
+// by a protobuf body, each uvarint-length-prefixed.
+var ProtoCodec = Codec{
+	ContentType: ProtoContentType,
+	NewClientCodec: func(conn net.Conn, limits Limits) rpc.ClientCodec {
+		return NewClientCodecWithLimits(conn, limits)
+	},
+	NewServerCodec: func(r *bufio.Reader, w io.WriteCloser, limits Limits) rpc.ServerCodec {
+		return newServerCodec(r, w, limits, uvarintFrame)
+	},
+}
+
+// GRPCCodec speaks the same wire.Header scheme as ProtoCodec, but frames
+// each message the way gRPC does: a 1-byte compressed flag (always 0 --
+// this Codec does not support compressed frames) followed by a 4-byte
+// big-endian length.  This lets a go-rpcgen service interoperate with
+// tooling that expects gRPC-style message framing without requiring a full
+// HTTP/2 stack.
+var GRPCCodec = Codec{
+	ContentType: GRPCContentType,
+	NewClientCodec: func(conn net.Conn, limits Limits) rpc.ClientCodec {
+		return newClientCodec(bufio.NewReader(conn), conn, limits, grpcFrame)
+	},
+	NewServerCodec: func(r *bufio.Reader, w io.WriteCloser, limits Limits) rpc.ServerCodec {
+		return newServerCodec(r, w, limits, grpcFrame)
+	},
+}
+
+// JSONCodec uses the standard library's net/rpc/jsonrpc wire format instead
+// of go-rpcgen's protobuf header, so generic JSON-speaking RPC tooling can
+// call a go-rpcgen service for debugging.  It does not enforce Limits;
+// encoding/json bounds its own allocation to what it actually decodes.
+var JSONCodec = Codec{
+	ContentType: JSONContentType,
+	NewClientCodec: func(conn net.Conn, limits Limits) rpc.ClientCodec {
+		return jsonrpc.NewClientCodec(conn)
+	},
+	NewServerCodec: func(r *bufio.Reader, w io.WriteCloser, limits Limits) rpc.ServerCodec {
+		return jsonrpc.NewServerCodec(bufferedConn{r, w})
+	},
+}
+
+func init() {
+	RegisterCodec(ProtoCodec)
+	RegisterCodec(GRPCCodec)
+	RegisterCodec(JSONCodec)
+}
+
+// bufferedConn adapts a *bufio.Reader plus an io.WriteCloser into an
+// io.ReadWriteCloser, so a negotiated Codec can keep reading from the same
+// buffer NegotiateServerCodec used to read the wire.Hello instead of
+// dropping whatever it had already buffered.
+type bufferedConn struct {
+	*bufio.Reader
+	io.WriteCloser
+}
+
+// writeHello writes a uvarint-prefixed wire.Hello naming contentType to w.
+func writeHello(w io.Writer, contentType string) error {
+	hello := &wire.Hello{ContentType: &contentType}
+	data, err := proto.Marshal(hello)
+	if err != nil {
+		return err
+	}
+	return writeUvarintMessage(w, data)
+}
+
+// NegotiateClientCodec announces codec.ContentType to the server with a
+// wire.Hello and returns the rpc.ClientCodec for codec.
+func NegotiateClientCodec(conn net.Conn, limits Limits, codec Codec) (rpc.ClientCodec, error) {
+	if err := writeHello(conn, codec.ContentType); err != nil {
+		return nil, err
+	}
+	return codec.NewClientCodec(conn, limits), nil
+}
+
+// NegotiateServerCodec reads the wire.Hello a NegotiateClientCodec caller
+// sent and returns the rpc.ServerCodec registered for the content type it
+// names, falling back to ProtoCodec if the content type is empty or
+// unregistered.
+func NegotiateServerCodec(conn net.Conn, limits Limits) (rpc.ServerCodec, error) {
+	return NegotiateServerCodecWithDefault(conn, limits, ProtoCodec)
+}
+
+// NegotiateServerCodecWithDefault is like NegotiateServerCodec but lets the
+// caller choose the Codec to fall back to instead of ProtoCodec.
+func NegotiateServerCodecWithDefault(conn net.Conn, limits Limits, fallback Codec) (rpc.ServerCodec, error) {
+	r := bufio.NewReader(conn)
+	message, err := readSizedMessage(r, conn, limits)
+	if err != nil {
+		return nil, err
+	}
+	var hello wire.Hello
+	if err := proto.Unmarshal(message, &hello); err != nil {
+		return nil, err
+	}
+	codec, ok := CodecByContentType(hello.GetContentType())
+	if !ok {
+		codec = fallback
+	}
+	return codec.NewServerCodec(r, conn, limits), nil
+}
@@ -0,0 +1,315 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"github.com/kylelemons/go-rpcgen/services/wire"
+)
+
+// fakeCloser records whether Close was called, standing in for the
+// connection readSizedMessage closes when a declared size exceeds limits.
+type fakeCloser struct {
+	closed bool
+}
+
+func (c *fakeCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+// TestReadSizedMessageAtLimit confirms a message exactly at MaxMessageSize
+// is accepted, not rejected by an off-by-one in the bound check.
+func TestReadSizedMessageAtLimit(t *testing.T) {
+	limits := Limits{MaxMessageSize: 4}
+	var buf bytes.Buffer
+	if err := writeUvarintMessage(&buf, []byte("abcd")); err != nil {
+		t.Fatalf("writeUvarintMessage: %v", err)
+	}
+	closer := new(fakeCloser)
+	got, err := readSizedMessage(bufio.NewReader(&buf), closer, limits)
+	if err != nil {
+		t.Fatalf("readSizedMessage: %v", err)
+	}
+	if string(got) != "abcd" {
+		t.Fatalf("got %q, want %q", got, "abcd")
+	}
+	if closer.closed {
+		t.Fatal("readSizedMessage closed the connection for a message within limits")
+	}
+}
+
+// TestReadSizedMessageOverLimit confirms a message one byte over
+// MaxMessageSize is rejected with ErrMessageTooLarge and the connection
+// closed, rather than being allocated and read anyway.
+func TestReadSizedMessageOverLimit(t *testing.T) {
+	limits := Limits{MaxMessageSize: 4}
+	var buf bytes.Buffer
+	if err := writeUvarintMessage(&buf, []byte("abcde")); err != nil {
+		t.Fatalf("writeUvarintMessage: %v", err)
+	}
+	closer := new(fakeCloser)
+	_, err := readSizedMessage(bufio.NewReader(&buf), closer, limits)
+	if err != ErrMessageTooLarge {
+		t.Fatalf("got error %v, want ErrMessageTooLarge", err)
+	}
+	if !closer.closed {
+		t.Fatal("readSizedMessage did not close the connection for an oversized message")
+	}
+}
+
+// TestReadSizedMessageZeroLength confirms a declared size of zero is read
+// successfully as an empty message, not mistaken for an error.
+func TestReadSizedMessageZeroLength(t *testing.T) {
+	limits := Limits{MaxMessageSize: 4}
+	var buf bytes.Buffer
+	if err := writeUvarintMessage(&buf, nil); err != nil {
+		t.Fatalf("writeUvarintMessage: %v", err)
+	}
+	got, err := readSizedMessage(bufio.NewReader(&buf), new(fakeCloser), limits)
+	if err != nil {
+		t.Fatalf("readSizedMessage: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("got %q, want empty", got)
+	}
+}
+
+// TestLimitsMaxMessageSizeDefaultsWhenZero confirms the zero value of
+// Limits falls back to DefaultMaxMessageSize rather than rejecting or
+// allowing every message.
+func TestLimitsMaxMessageSizeDefaultsWhenZero(t *testing.T) {
+	var limits Limits
+	if got, want := limits.maxMessageSize(), uint64(DefaultMaxMessageSize); got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+}
+
+// TestServerCodecReadRequestBodyEnforcesLimit is an end-to-end regression
+// test: a request body larger than the ServerCodec's configured Limits must
+// surface as ErrMessageTooLarge from ReadRequestBody, the path a real
+// peer-controlled oversized message would take.
+func TestServerCodecReadRequestBodyEnforcesLimit(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	// Large enough for the request header itself, too small for the body
+	// written below.
+	sc := NewServerCodecWithLimits(sconn, Limits{MaxMessageSize: 512})
+
+	method := "Test.Echo"
+	seq := uint64(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeTestHeader(t, cconn, &wire.Header{Method: &method, Seq: &seq, Type: wire.Header_REQUEST.Enum()})
+		// ReadRequestBody rejects the declared size before reading any of
+		// the body, closing sconn (and so cconn too) right away -- this
+		// write racing that close is expected to fail and isn't itself the
+		// thing under test.
+		writeUvarintMessage(cconn, bytes.Repeat([]byte("x"), 1000))
+	}()
+
+	var req rpc.Request
+	if err := sc.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("ReadRequestHeader: %v", err)
+	}
+	err := sc.ReadRequestBody(new(wire.Header))
+	if err != ErrMessageTooLarge {
+		t.Fatalf("got error %v, want ErrMessageTooLarge", err)
+	}
+	<-done
+}
+
+// TestWriteReadGRPCMessageRoundTrip exercises writeGRPCMessage/readGRPCMessage
+// directly, the framing NegotiateClientCodec/NegotiateServerCodec select for
+// GRPCCodec: a message within limits round-trips, an oversized one is
+// rejected with ErrMessageTooLarge and the connection closed, and a set
+// compressed-flag byte (unsupported by this framing) is rejected too.
+func TestWriteReadGRPCMessageRoundTrip(t *testing.T) {
+	limits := Limits{MaxMessageSize: 4}
+
+	var buf bytes.Buffer
+	if err := writeGRPCMessage(&buf, []byte("abcd")); err != nil {
+		t.Fatalf("writeGRPCMessage: %v", err)
+	}
+	closer := new(fakeCloser)
+	got, err := readGRPCMessage(bufio.NewReader(&buf), closer, limits)
+	if err != nil {
+		t.Fatalf("readGRPCMessage: %v", err)
+	}
+	if string(got) != "abcd" {
+		t.Fatalf("got %q, want %q", got, "abcd")
+	}
+	if closer.closed {
+		t.Fatal("readGRPCMessage closed the connection for a message within limits")
+	}
+
+	buf.Reset()
+	if err := writeGRPCMessage(&buf, []byte("abcde")); err != nil {
+		t.Fatalf("writeGRPCMessage: %v", err)
+	}
+	closer = new(fakeCloser)
+	if _, err := readGRPCMessage(bufio.NewReader(&buf), closer, limits); err != ErrMessageTooLarge {
+		t.Fatalf("got error %v, want ErrMessageTooLarge", err)
+	}
+	if !closer.closed {
+		t.Fatal("readGRPCMessage did not close the connection for an oversized message")
+	}
+
+	buf.Reset()
+	buf.Write([]byte{1, 0, 0, 0, 0}) // compressed flag set, zero-length body
+	closer = new(fakeCloser)
+	if _, err := readGRPCMessage(bufio.NewReader(&buf), closer, limits); err == nil {
+		t.Fatal("readGRPCMessage: got nil error for a compressed frame, want an error")
+	}
+	if !closer.closed {
+		t.Fatal("readGRPCMessage did not close the connection for a compressed frame")
+	}
+}
+
+// negotiatedRoundTrip negotiates codec over a net.Pipe and runs one full
+// request/response cycle through the resulting rpc.ClientCodec/ServerCodec,
+// proving that NegotiateServerCodecWithDefault actually wired up codec's
+// framing and not some other one.
+func negotiatedRoundTrip(t *testing.T, codec Codec, fallback Codec) {
+	t.Helper()
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	limits := Limits{MaxMessageSize: 512}
+
+	serverDone := make(chan error, 1)
+	var server rpc.ServerCodec
+	go func() {
+		var err error
+		server, err = NegotiateServerCodecWithDefault(sconn, limits, fallback)
+		serverDone <- err
+	}()
+
+	client, err := NegotiateClientCodec(cconn, limits, codec)
+	if err != nil {
+		t.Fatalf("NegotiateClientCodec: %v", err)
+	}
+	if err := <-serverDone; err != nil {
+		t.Fatalf("NegotiateServerCodecWithDefault: %v", err)
+	}
+
+	method := "Test.Echo"
+	clientDone := make(chan error, 1)
+	go func() {
+		clientDone <- client.WriteRequest(&rpc.Request{ServiceMethod: method, Seq: 1}, &wire.Header{Method: &method})
+	}()
+
+	var req rpc.Request
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("ReadRequestHeader: %v", err)
+	}
+	if req.ServiceMethod != method {
+		t.Fatalf("got ServiceMethod %q, want %q", req.ServiceMethod, method)
+	}
+	var body wire.Header
+	if err := server.ReadRequestBody(&body); err != nil {
+		t.Fatalf("ReadRequestBody: %v", err)
+	}
+	if err := <-clientDone; err != nil {
+		t.Fatalf("WriteRequest: %v", err)
+	}
+
+	serverDone2 := make(chan error, 1)
+	go func() {
+		serverDone2 <- server.WriteResponse(&rpc.Response{ServiceMethod: method, Seq: req.Seq}, &wire.Header{Method: &method})
+	}()
+
+	var resp rpc.Response
+	if err := client.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("ReadResponseHeader: %v", err)
+	}
+	var respBody wire.Header
+	if err := client.ReadResponseBody(&respBody); err != nil {
+		t.Fatalf("ReadResponseBody: %v", err)
+	}
+	if respBody.GetMethod() != method {
+		t.Fatalf("got response method %q, want %q", respBody.GetMethod(), method)
+	}
+	if err := <-serverDone2; err != nil {
+		t.Fatalf("WriteResponse: %v", err)
+	}
+}
+
+// TestNegotiateSelectsCodecByContentType confirms NegotiateServerCodec picks
+// the Codec the client's wire.Hello named, for each content type a client
+// might actually request, not just whichever Codec happens to be the
+// fallback.
+func TestNegotiateSelectsCodecByContentType(t *testing.T) {
+	for _, codec := range []Codec{ProtoCodec, GRPCCodec} {
+		t.Run(codec.ContentType, func(t *testing.T) {
+			// Pass the other codec as fallback, so the test would fail if
+			// negotiation fell through to it instead of honoring the Hello.
+			fallback := ProtoCodec
+			if codec.ContentType == ProtoContentType {
+				fallback = GRPCCodec
+			}
+			negotiatedRoundTrip(t, codec, fallback)
+		})
+	}
+}
+
+// TestNegotiateServerCodecFallsBackOnUnknownContentType confirms a Hello
+// naming an unregistered content type falls back to the given default Codec
+// rather than erroring, e.g. for an old client that predates a newly added
+// Codec.
+func TestNegotiateServerCodecFallsBackOnUnknownContentType(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	limits := Limits{MaxMessageSize: 512}
+
+	serverDone := make(chan error, 1)
+	var server rpc.ServerCodec
+	go func() {
+		var err error
+		server, err = NegotiateServerCodecWithDefault(sconn, limits, GRPCCodec)
+		serverDone <- err
+	}()
+
+	if err := writeHello(cconn, "application/unknown"); err != nil {
+		t.Fatalf("writeHello: %v", err)
+	}
+	if err := <-serverDone; err != nil {
+		t.Fatalf("NegotiateServerCodecWithDefault: %v", err)
+	}
+
+	// The server fell back to GRPCCodec, so it now expects gRPC framing for
+	// the request that follows.
+	method := "Test.Echo"
+	seq := uint64(1)
+	header, err := proto.Marshal(&wire.Header{Method: &method, Seq: &seq})
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeGRPCMessage(cconn, header)
+		body, _ := proto.Marshal(&wire.Header{Method: &method})
+		writeGRPCMessage(cconn, body)
+	}()
+
+	var req rpc.Request
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("ReadRequestHeader: %v", err)
+	}
+	if err := server.ReadRequestBody(new(wire.Header)); err != nil {
+		t.Fatalf("ReadRequestBody: %v", err)
+	}
+	<-done
+}
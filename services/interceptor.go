@@ -0,0 +1,269 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// ClientInterceptor wraps a single client call, the way a gRPC unary
+// interceptor does. Implementations must eventually call next to drive the
+// actual RPC; it returns next's error, having observed or retried around
+// it. in and out are the same arguments and reply CallWithContext was
+// given, as proto.Message, so an interceptor can inspect them without
+// needing to know the generated service's concrete types. ctx is the one
+// CallWithContext was given, so an interceptor that waits between calls of
+// its own (RetryInterceptor's backoff, say) can abort that wait as soon as
+// ctx is done instead of blocking for its full duration regardless.
+type ClientInterceptor func(ctx context.Context, method string, in, out proto.Message, next func() error) error
+
+// ServerInterceptor is the server-side analogue of ClientInterceptor,
+// wrapping the invocation of a backend's method by the generated
+// rpc{Name}Backend adapter.
+type ServerInterceptor func(method string, in, out proto.Message, next func() error) error
+
+// ChainClientInterceptors composes interceptors around invoke, with
+// interceptors[0] outermost (the first to see the call, the last to see
+// its result).
+func ChainClientInterceptors(interceptors []ClientInterceptor, ctx context.Context, method string, in, out proto.Message, invoke func() error) error {
+	next := invoke
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, cur := interceptors[i], next
+		next = func() error { return ic(ctx, method, in, out, cur) }
+	}
+	return next()
+}
+
+// ChainServerInterceptors is ChainClientInterceptors' server-side
+// counterpart.
+func ChainServerInterceptors(interceptors []ServerInterceptor, method string, in, out proto.Message, invoke func() error) error {
+	next := invoke
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, cur := interceptors[i], next
+		next = func() error { return ic(method, in, out, cur) }
+	}
+	return next()
+}
+
+// ClientOption configures a ClientCodec built by NewClientCodecWithOptions.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	interceptors []ClientInterceptor
+}
+
+// WithClientInterceptors registers interceptors to run, outermost first,
+// around every call CallWithContext makes through the resulting
+// ClientCodec.
+func WithClientInterceptors(interceptors ...ClientInterceptor) ClientOption {
+	return func(o *clientOptions) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// NewClientCodecWithOptions is like NewClientCodecWithLimits but lets the
+// caller attach ClientOptions, e.g. WithClientInterceptors.
+func NewClientCodecWithOptions(conn net.Conn, limits Limits, opts ...ClientOption) *ClientCodec {
+	var o clientOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c := newClientCodec(bufio.NewReader(conn), conn, limits, uvarintFrame)
+	c.interceptors = o.interceptors
+	return c
+}
+
+// BackoffConfig controls RetryInterceptor's delay between attempts,
+// mirroring grpc-go's backoff.Config: the delay grows from BaseDelay by
+// Factor each retry, capped at MaxDelay, then jittered by +/-Jitter so that
+// many clients backing off from the same failure don't retry in lockstep.
+type BackoffConfig struct {
+	BaseDelay time.Duration
+	Factor    float64
+	Jitter    float64
+	MaxDelay  time.Duration
+}
+
+// DefaultBackoffConfig is a reasonable default for RetryInterceptor,
+// matching grpc-go's.
+var DefaultBackoffConfig = BackoffConfig{
+	BaseDelay: 1.0 * time.Second,
+	Factor:    1.6,
+	Jitter:    0.2,
+	MaxDelay:  120 * time.Second,
+}
+
+// delay computes backoff's delay before the (0-indexed) retries-th retry:
+// min(MaxDelay, BaseDelay*Factor^retries), jittered by +/-Jitter.
+func (backoff BackoffConfig) delay(retries int) time.Duration {
+	d := float64(backoff.BaseDelay)
+	max := float64(backoff.MaxDelay)
+	for i := 0; i < retries && d < max; i++ {
+		d *= backoff.Factor
+	}
+	if d > max {
+		d = max
+	}
+	d *= 1 + backoff.Jitter*(2*rand.Float64()-1)
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// IdempotentMethods names the "Service.Method" calls RetryInterceptor is
+// allowed to retry. Retrying a call whose effect isn't idempotent (e.g. one
+// that appends to a log or moves money) risks applying it twice, so
+// RetryInterceptor only retries methods this reports true for.
+type IdempotentMethods map[string]bool
+
+// IsIdempotent reports whether method was named in m.
+func (m IdempotentMethods) IsIdempotent(method string) bool {
+	return m[method]
+}
+
+// RetryInterceptor returns a ClientInterceptor that retries a call up to
+// maxRetries times, waiting backoff.delay(retries) between attempts, when
+// it fails with a transient transport error (io.EOF, io.ErrUnexpectedEOF,
+// rpc.ErrShutdown, or a *net.OpError) and idempotent reports the method
+// safe to retry. It stops waiting out a pending backoff, without starting
+// another attempt, as soon as ctx is done, since next would just see the
+// same done ctx and fail again.
+func RetryInterceptor(maxRetries int, backoff BackoffConfig, idempotent IdempotentMethods) ClientInterceptor {
+	return func(ctx context.Context, method string, in, out proto.Message, next func() error) error {
+		if !idempotent.IsIdempotent(method) {
+			return next()
+		}
+		for retries := 0; ; retries++ {
+			err := next()
+			if err == nil || !isTransientError(err) || retries >= maxRetries {
+				return err
+			}
+			timer := time.NewTimer(backoff.delay(retries))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// isTransientError reports whether err looks like a failure of the
+// underlying transport rather than of the call itself, and so might
+// succeed if simply retried.
+func isTransientError(err error) bool {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, rpc.ErrShutdown:
+		return true
+	}
+	_, ok := err.(*net.OpError)
+	return ok
+}
+
+// LoggingInterceptor returns a ClientInterceptor that logs each call's
+// method, duration, and outcome to logger.
+func LoggingInterceptor(logger *log.Logger) ClientInterceptor {
+	return func(ctx context.Context, method string, in, out proto.Message, next func() error) error {
+		start := time.Now()
+		err := next()
+		if err != nil {
+			logger.Printf("%s: error after %s: %v", method, time.Since(start), err)
+		} else {
+			logger.Printf("%s: ok in %s", method, time.Since(start))
+		}
+		return err
+	}
+}
+
+// ServerLoggingInterceptor is LoggingInterceptor's server-side counterpart.
+func ServerLoggingInterceptor(logger *log.Logger) ServerInterceptor {
+	return func(method string, in, out proto.Message, next func() error) error {
+		start := time.Now()
+		err := next()
+		if err != nil {
+			logger.Printf("%s: error after %s: %v", method, time.Since(start), err)
+		} else {
+			logger.Printf("%s: ok in %s", method, time.Since(start))
+		}
+		return err
+	}
+}
+
+// MetricsRecorder receives each call's outcome from MetricsInterceptor or
+// ServerMetricsInterceptor. A *Metrics satisfies it directly for simple
+// in-process counting; a caller wanting real Prometheus output can instead
+// implement it over a prometheus.CounterVec/HistogramVec without this
+// module needing to depend on the Prometheus client itself.
+type MetricsRecorder interface {
+	ObserveCall(method string, duration time.Duration, err error)
+}
+
+// MetricsInterceptor returns a ClientInterceptor that reports each call's
+// duration and outcome to r.
+func MetricsInterceptor(r MetricsRecorder) ClientInterceptor {
+	return func(ctx context.Context, method string, in, out proto.Message, next func() error) error {
+		start := time.Now()
+		err := next()
+		r.ObserveCall(method, time.Since(start), err)
+		return err
+	}
+}
+
+// ServerMetricsInterceptor is MetricsInterceptor's server-side counterpart.
+func ServerMetricsInterceptor(r MetricsRecorder) ServerInterceptor {
+	return func(method string, in, out proto.Message, next func() error) error {
+		start := time.Now()
+		err := next()
+		r.ObserveCall(method, time.Since(start), err)
+		return err
+	}
+}
+
+// Metrics is a minimal, dependency-free MetricsRecorder: per-method call
+// counts, error counts, and total latency, in the Prometheus
+// counter/histogram style of labeling by method without requiring this
+// module to take on the Prometheus client as a dependency.
+type Metrics struct {
+	mu      sync.Mutex
+	calls   map[string]uint64
+	errors  map[string]uint64
+	latency map[string]time.Duration
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		calls:   make(map[string]uint64),
+		errors:  make(map[string]uint64),
+		latency: make(map[string]time.Duration),
+	}
+}
+
+// ObserveCall implements MetricsRecorder.
+func (m *Metrics) ObserveCall(method string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[method]++
+	m.latency[method] += duration
+	if err != nil {
+		m.errors[method]++
+	}
+}
+
+// Snapshot returns the calls, errors, and cumulative latency observed for
+// method so far.
+func (m *Metrics) Snapshot(method string) (calls, errors uint64, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[method], m.errors[method], m.latency[method]
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestRetryInterceptorAbortsOnContextDone is a regression test: the wait
+// between retries must be interruptible by ctx, or a caller whose context
+// expires mid-backoff blocks for the rest of backoff.delay regardless,
+// instead of the call returning promptly the way CallWithContext does
+// outside of RetryInterceptor.
+func TestRetryInterceptorAbortsOnContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backoff := BackoffConfig{BaseDelay: time.Hour, Factor: 1, Jitter: 0, MaxDelay: time.Hour}
+	retry := RetryInterceptor(5, backoff, IdempotentMethods{"Test.Echo": true})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := retry(ctx, "Test.Echo", nil, nil, func() error { return io.EOF })
+	elapsed := time.Since(start)
+
+	if err != context.Canceled {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("RetryInterceptor took %s to return after ctx was canceled; it should have aborted its backoff wait immediately instead of sleeping out BaseDelay", elapsed)
+	}
+}
+
+// TestRetryInterceptorSkipsNonIdempotent confirms a non-idempotent method is
+// never retried, even on a transient error.
+func TestRetryInterceptorSkipsNonIdempotent(t *testing.T) {
+	retry := RetryInterceptor(5, DefaultBackoffConfig, IdempotentMethods{"Test.Other": true})
+
+	calls := 0
+	err := retry(context.Background(), "Test.Echo", nil, nil, func() error {
+		calls++
+		return io.EOF
+	})
+	if err != io.EOF {
+		t.Fatalf("got error %v, want io.EOF", err)
+	}
+	if calls != 1 {
+		t.Fatalf("next was called %d times, want exactly 1 (no retries for a non-idempotent method)", calls)
+	}
+}
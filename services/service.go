@@ -2,11 +2,16 @@ package services
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"fmt"
 	"net"
 	"net/rpc"
+	"sync"
+	"time"
+	"unicode"
 
 	descriptor "code.google.com/p/goprotobuf/compiler/descriptor"
 	"code.google.com/p/goprotobuf/compiler/generator"
@@ -17,25 +22,168 @@ import (
 
 // TODO: Use io.ReadWriteCloser instead of net.Conn?
 
+// DefaultMaxMessageSize is the MaxMessageSize used by NewServerCodec and
+// NewClientCodec, and by the generated helpers that don't take a Limits
+// explicitly.  16MiB is large enough for any reasonable protobuf while still
+// bounding the damage a malicious or buggy peer can do with a forged length.
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+
+// ErrMessageTooLarge is returned by a codec's Read* methods when the declared
+// size of an incoming message exceeds the configured Limits.MaxMessageSize.
+// The underlying connection is closed before this error is returned, since
+// there is no way to know how much (if any) of the oversized message the
+// peer will actually send.
+var ErrMessageTooLarge = errors.New("services: message exceeds MaxMessageSize")
+
+// Limits bounds the resources a ServerCodec or ClientCodec will spend on a
+// single connection.
+type Limits struct {
+	// MaxMessageSize is the largest framed message (header or body),
+	// uvarint- or gRPC-prefixed, that will be allocated and read.  A declared size larger than
+	// this causes the codec to close the connection and return
+	// ErrMessageTooLarge.  Zero means DefaultMaxMessageSize.
+	MaxMessageSize uint64
+}
+
+// DefaultLimits is the Limits used when none is given explicitly.
+var DefaultLimits = Limits{MaxMessageSize: DefaultMaxMessageSize}
+
+func (l Limits) maxMessageSize() uint64 {
+	if l.MaxMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return l.MaxMessageSize
+}
+
+// readSizedMessage reads a uvarint-prefixed message from r, closing closer
+// and returning ErrMessageTooLarge if the declared size exceeds limits.
+func readSizedMessage(r *bufio.Reader, closer io.Closer, limits Limits) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > limits.maxMessageSize() {
+		closer.Close()
+		return nil, ErrMessageTooLarge
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeUvarintMessage writes data to w prefixed with a uvarint indicating its
+// length, the framing used by the "application/proto-rpc" Codec.
+func writeUvarintMessage(w io.Writer, data []byte) error {
+	size := make([]byte, binary.MaxVarintLen64)
+	size = size[:binary.PutUvarint(size, uint64(len(data)))]
+	if _, err := w.Write(size); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// frameIO pairs the functions that read and write a single message on the
+// wire, abstracting away how its length is framed so that ServerCodec and
+// ClientCodec can be reused across Codecs that share the wire.Header scheme
+// but disagree on framing (see codec.go).
+type frameIO struct {
+	read  func(r *bufio.Reader, closer io.Closer, limits Limits) ([]byte, error)
+	write func(w io.Writer, data []byte) error
+}
+
+// uvarintFrame is the original, default framing: each message is prefixed by
+// a uvarint giving its length.
+var uvarintFrame = frameIO{read: readSizedMessage, write: writeUvarintMessage}
+
+// writeGRPCMessage writes data to w using gRPC's message framing: a 1-byte
+// compressed flag (always 0, since this framing doesn't support compression)
+// followed by a 4-byte big-endian length.
+func writeGRPCMessage(w io.Writer, data []byte) error {
+	head := make([]byte, 5)
+	binary.BigEndian.PutUint32(head[1:], uint32(len(data)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readGRPCMessage reads a gRPC-framed message from r, closing closer and
+// returning ErrMessageTooLarge if the declared size exceeds limits.
+func readGRPCMessage(r *bufio.Reader, closer io.Closer, limits Limits) ([]byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != 0 {
+		closer.Close()
+		return nil, fmt.Errorf("services: compressed grpc frames are not supported")
+	}
+	size := uint64(binary.BigEndian.Uint32(head[1:]))
+	if size > limits.maxMessageSize() {
+		closer.Close()
+		return nil, ErrMessageTooLarge
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// grpcFrame frames messages the way gRPC does (see GRPCCodec).
+var grpcFrame = frameIO{read: readGRPCMessage, write: writeGRPCMessage}
+
 // GenerateService is the core of the services package.
 // It generates an interface based on the ServiceDescriptorProto and an RPC
 // client implementation of the interface as well as three helper functions
 // to create the Client and Server necessary to utilize the service over
-// RPC.
+// RPC.  Services with at least one streaming method are generated on top
+// of services.StreamCodec instead, since net/rpc has no notion of a
+// long-lived call; see generateStreamingService.
 func (p *Plugin) GenerateService(svc *descriptor.ServiceDescriptorProto) {
 	p.imports = true
 
+	if hasStreamingMethod(svc) {
+		p.generateStreamingService(svc)
+		return
+	}
+	p.generateUnaryService(svc)
+}
+
+// hasStreamingMethod reports whether svc has any method with client or
+// server streaming, the way gRPC's MethodDescriptorProto marks them.
+func hasStreamingMethod(svc *descriptor.ServiceDescriptorProto) bool {
+	for _, m := range svc.Method {
+		if m.GetClientStreaming() || m.GetServerStreaming() {
+			return true
+		}
+	}
+	return false
+}
+
+// generateUnaryService emits the interface, the net/rpc-backed client and
+// server wrappers, and the Dial/Serve/ListenAndServe helpers for a service
+// whose methods are all plain unary RPCs.
+func (p *Plugin) generateUnaryService(svc *descriptor.ServiceDescriptorProto) {
 	name := generator.CamelCase(*svc.Name)
 
 	p.P("// ", name, " is an interface satisfied by the generated client and")
-	p.P("// which must be implemented by the object wrapped by the server.")
+	p.P("// which must be implemented by the object wrapped by the server. ctx is")
+	p.P("// honored on both ends: the client serializes its deadline into the")
+	p.P("// request and cancels the call on the wire if ctx is done first, and the")
+	p.P("// server builds ctx from the deadline and cancellation notices it")
+	p.P("// receives rather than running the call with an unbounded context.")
 	p.P("type ", name, " interface {")
 	p.In()
 	for _, m := range svc.Method {
 		method := generator.CamelCase(*m.Name)
 		iType := p.ObjectNamed(*m.InputType)
 		oType := p.ObjectNamed(*m.OutputType)
-		p.P(method, "(in *", p.TypeName(iType), ", out *", p.TypeName(oType), ") error")
+		p.P(method, "(ctx context.Context, in *", p.TypeName(iType), ", out *", p.TypeName(oType), ") error")
 	}
 	p.Out()
 	p.P("}")
@@ -44,57 +192,219 @@ func (p *Plugin) GenerateService(svc *descriptor.ServiceDescriptorProto) {
 	p.P("type rpc", name, "Client struct {")
 	p.In()
 	p.P("*rpc.Client")
+	p.P("codec rpc.ClientCodec")
 	p.Out()
 	p.P("}")
 	for _, m := range svc.Method {
 		method := generator.CamelCase(*m.Name)
 		iType := p.ObjectNamed(*m.InputType)
 		oType := p.ObjectNamed(*m.OutputType)
-		p.P("func (this rpc", name, "Client) ", method, "(in *", p.TypeName(iType), ", out *", p.TypeName(oType), ") error {")
+		p.P("func (this rpc", name, "Client) ", method, "(ctx context.Context, in *", p.TypeName(iType), ", out *", p.TypeName(oType), ") error {")
 		p.In()
-		p.P(`return this.Call("`, name, ".", method, `", in, out)`)
+		p.P(`return services.CallWithContext(this.Client, this.codec, ctx, "`, name, ".", method, `", in, out)`)
 		p.Out()
 		p.P("}")
 	}
 	p.P()
+	p.P("// internal wrapper adapting a ", name, " backend to net/rpc's calling")
+	p.P("// convention: each method's net/rpc-visible argument pairs the request")
+	p.P("// with the context ServerCodec built for it, since net/rpc's")
+	p.P("// reflection-based dispatch has no other way to hand a method")
+	p.P("// per-call metadata. It also runs interceptors around the backend call")
+	p.P("// and recovers a panic from it, since net/rpc runs each method in its")
+	p.P("// own goroutine that nothing else guards against a panicking backend.")
+	p.P("type rpc", name, "Backend struct {")
+	p.In()
+	p.P("backend ", name)
+	p.P("interceptors []services.ServerInterceptor")
+	p.Out()
+	p.P("}")
+	for _, m := range svc.Method {
+		method := generator.CamelCase(*m.Name)
+		iType := p.TypeName(p.ObjectNamed(*m.InputType))
+		oType := p.TypeName(p.ObjectNamed(*m.OutputType))
+		inType := name + method + "In"
+		p.P("type ", inType, " struct {")
+		p.In()
+		p.P("Ctx context.Context")
+		p.P("In  *", iType)
+		p.Out()
+		p.P("}")
+		p.P()
+		p.P("func (in *", inType, ") SetContext(ctx context.Context) { in.Ctx = ctx }")
+		p.P()
+		p.P("func (in *", inType, ") Body() proto.Message {")
+		p.In()
+		p.P("if in.In == nil {")
+		p.In()
+		p.P("in.In = &", iType, "{}")
+		p.Out()
+		p.P("}")
+		p.P("return in.In")
+		p.Out()
+		p.P("}")
+		p.P()
+		p.P("func (a rpc", name, "Backend) ", method, "(in *", inType, ", out *", oType, ") (err error) {")
+		p.In()
+		p.P("defer func() {")
+		p.In()
+		p.P("if r := recover(); r != nil {")
+		p.In()
+		p.P(`log.Printf("`, name, ".", method, `: panic: %v", r)`)
+		p.P(`err = fmt.Errorf("`, name, ".", method, `: panic: %v", r)`)
+		p.Out()
+		p.P("}")
+		p.Out()
+		p.P("}()")
+		p.P(`return services.ChainServerInterceptors(a.interceptors, "`, name, ".", method, `", in.In, out, func() error {`)
+		p.In()
+		p.P("return a.backend.", method, "(in.Ctx, in.In, out)")
+		p.Out()
+		p.P("})")
+		p.Out()
+		p.P("}")
+		p.P()
+	}
 	p.P("// New", name, "Client returns an *rpc.Client wrapper for calling the methods of")
-	p.P("// ", name, " remotely.")
+	p.P("// ", name, " remotely, bounding message sizes to services.DefaultLimits.")
 	p.P("func New", name, "Client(conn net.Conn) ", name, " {")
 	p.In()
-	p.P("return rpc", name, "Client{rpc.NewClientWithCodec(services.NewClientCodec(conn))}")
+	p.P("return New", name, "ClientWithLimits(conn, services.DefaultLimits)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// New", name, "ClientWithLimits is like New", name, "Client but lets the caller")
+	p.P("// bound the size of the messages the client will allocate for.")
+	p.P("func New", name, "ClientWithLimits(conn net.Conn, limits services.Limits) ", name, " {")
+	p.In()
+	p.P("codec := services.NewClientCodecWithLimits(conn, limits)")
+	p.P("return rpc", name, "Client{rpc.NewClientWithCodec(codec), codec}")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// New", name, "ClientWithCodec is like New", name, "Client but negotiates codec")
+	p.P("// with the server instead of assuming services.ProtoCodec, so callers can")
+	p.P("// interoperate with JSON debugging tools or gRPC-framed peers. Deadline")
+	p.P("// and cancellation propagation require codec to be a")
+	p.P("// services.ContextCodec (true of services.ProtoCodec and")
+	p.P("// services.GRPCCodec); against services.JSONCodec, ctx is still honored")
+	p.P("// locally but can't be communicated to the server.")
+	p.P("func New", name, "ClientWithCodec(conn net.Conn, codec services.Codec) (", name, ", error) {")
+	p.In()
+	p.P("rpcCodec, err := services.NegotiateClientCodec(conn, services.DefaultLimits, codec)")
+	p.P("if err != nil {")
+	p.In()
+	p.P("return nil, err")
+	p.Out()
+	p.P("}")
+	p.P("return rpc", name, "Client{rpc.NewClientWithCodec(rpcCodec), rpcCodec}, nil")
 	p.Out()
 	p.P("}")
 	p.P()
-	p.P("// Serve", name, " serves the given ", name, " backend implementation on conn.")
-	p.P("func Serve", name, "(conn net.Conn, backend ", name, ") error {")
+	p.P("// New", name, "ClientWithOptions is like New", name, "Client but lets the")
+	p.P("// caller configure the underlying ClientCodec, e.g. with")
+	p.P("// services.WithClientInterceptors to wrap every call in a chain of")
+	p.P("// ClientInterceptors such as services.RetryInterceptor.")
+	p.P("func New", name, "ClientWithOptions(conn net.Conn, opts ...services.ClientOption) ", name, " {")
+	p.In()
+	p.P("codec := services.NewClientCodecWithOptions(conn, services.DefaultLimits, opts...)")
+	p.P("return rpc", name, "Client{rpc.NewClientWithCodec(codec), codec}")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Serve", name, " serves the given ", name, " backend implementation on conn,")
+	p.P("// bounding message sizes to services.DefaultLimits.")
+	p.P("func Serve", name, "(conn net.Conn, backend ", name, ", interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P("return Serve", name, "WithLimits(conn, backend, services.DefaultLimits, interceptors...)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Serve", name, "WithLimits is like Serve", name, " but lets the caller bound")
+	p.P("// the size of the messages the server will allocate for.")
+	p.P("func Serve", name, "WithLimits(conn net.Conn, backend ", name, ", limits services.Limits, interceptors ...services.ServerInterceptor) error {")
 	p.In()
 	p.P("srv := rpc.NewServer()")
-	p.P(`if err := srv.RegisterName("`, name, `", backend); err != nil {`)
+	p.P(`if err := srv.RegisterName("`, name, `", rpc`, name, `Backend{backend, interceptors}); err != nil {`)
 	p.In()
 	p.P("return err")
 	p.Out()
 	p.P("}")
-	p.P("srv.ServeCodec(services.NewServerCodec(conn))")
+	p.P("srv.ServeCodec(services.NewServerCodecWithLimits(conn, limits))")
 	p.P("return nil")
 	p.Out()
 	p.P("}")
 	p.P()
-	p.P("// Dial", name, " returns a ", name, " for calling the ", name, " servince at addr (TCP).")
+	p.P("// Serve", name, "WithCodec is like Serve", name, " but negotiates codec with")
+	p.P("// the client instead of assuming services.ProtoCodec, falling back to")
+	p.P("// codec if the client doesn't negotiate one of its own.")
+	p.P("func Serve", name, "WithCodec(conn net.Conn, backend ", name, ", codec services.Codec, interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P("rpcCodec, err := services.NegotiateServerCodecWithDefault(conn, services.DefaultLimits, codec)")
+	p.P("if err != nil {")
+	p.In()
+	p.P("return err")
+	p.Out()
+	p.P("}")
+	p.P("srv := rpc.NewServer()")
+	p.P(`if err := srv.RegisterName("`, name, `", rpc`, name, `Backend{backend, interceptors}); err != nil {`)
+	p.In()
+	p.P("return err")
+	p.Out()
+	p.P("}")
+	p.P("srv.ServeCodec(rpcCodec)")
+	p.P("return nil")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Dial", name, " returns a ", name, " for calling the ", name, " servince at")
+	p.P("// addr (TCP), bounding message sizes to services.DefaultLimits.")
 	p.P("func Dial", name, "(addr string) (", name, ", error) {")
 	p.In()
+	p.P("return Dial", name, "WithLimits(addr, services.DefaultLimits)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Dial", name, "WithLimits is like Dial", name, " but lets the caller bound")
+	p.P("// the size of the messages the client will allocate for.")
+	p.P("func Dial", name, "WithLimits(addr string, limits services.Limits) (", name, ", error) {")
+	p.In()
 	p.P(`conn, err := net.Dial("tcp", addr)`)
 	p.P("if err != nil {")
 	p.In()
 	p.P("return nil, err")
 	p.Out()
 	p.P("}")
-	p.P("return New", name, "Client(conn), nil")
+	p.P("return New", name, "ClientWithLimits(conn, limits), nil")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Dial", name, "TLS is like Dial", name, " but dials addr over TLS using cfg.")
+	p.P("func Dial", name, "TLS(addr string, cfg *tls.Config) (", name, ", error) {")
+	p.In()
+	p.P(`conn, err := tls.Dial("tcp", addr, cfg)`)
+	p.P("if err != nil {")
+	p.In()
+	p.P("return nil, err")
+	p.Out()
+	p.P("}")
+	p.P("return New", name, "ClientWithLimits(conn, services.DefaultLimits), nil")
 	p.Out()
 	p.P("}")
 	p.P()
 	p.P("// ListenAndServe", name, " serves the given ", name, " backend implementation")
-	p.P("// on all connections accepted as a result of listening on addr (TCP).")
-	p.P("func ListenAndServe", name, "(addr string, backend ", name, ") error {")
+	p.P("// on all connections accepted as a result of listening on addr (TCP),")
+	p.P("// bounding message sizes to services.DefaultLimits.")
+	p.P("func ListenAndServe", name, "(addr string, backend ", name, ", interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P("return ListenAndServe", name, "WithLimits(addr, backend, services.DefaultLimits, interceptors...)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// ListenAndServe", name, "WithLimits is like ListenAndServe", name, " but")
+	p.P("// lets the caller bound the size of the messages the server will")
+	p.P("// allocate for.")
+	p.P("func ListenAndServe", name, "WithLimits(addr string, backend ", name, ", limits services.Limits, interceptors ...services.ServerInterceptor) error {")
 	p.In()
 	p.P(`clients, err := net.Listen("tcp", addr)`)
 	p.P("if err != nil {")
@@ -102,26 +412,608 @@ func (p *Plugin) GenerateService(svc *descriptor.ServiceDescriptorProto) {
 	p.P("return err")
 	p.Out()
 	p.P("}")
+	p.P("return Accept", name, "WithLimits(clients, backend, limits, interceptors...)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// ListenAndServe", name, "TLS is like ListenAndServe", name, " but accepts")
+	p.P("// only TLS connections configured by cfg.")
+	p.P("func ListenAndServe", name, "TLS(addr string, cfg *tls.Config, backend ", name, ", interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P(`clients, err := tls.Listen("tcp", addr, cfg)`)
+	p.P("if err != nil {")
+	p.In()
+	p.P("return err")
+	p.Out()
+	p.P("}")
+	p.P("return Accept", name, "(clients, backend, interceptors...)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Accept", name, " serves the given ", name, " backend implementation on")
+	p.P("// every connection accepted from l, bounding message sizes to")
+	p.P("// services.DefaultLimits. Unlike ListenAndServe", name, ", it lets the")
+	p.P("// caller supply its own net.Listener -- a unix socket, a tls.Listener, a")
+	p.P("// custom mux -- instead of dialing TCP itself.")
+	p.P("func Accept", name, "(l net.Listener, backend ", name, ", interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P("return Accept", name, "WithLimits(l, backend, services.DefaultLimits, interceptors...)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Accept", name, "WithLimits is like Accept", name, " but lets the caller")
+	p.P("// bound the size of the messages the server will allocate for.")
+	p.P("func Accept", name, "WithLimits(l net.Listener, backend ", name, ", limits services.Limits, interceptors ...services.ServerInterceptor) error {")
+	p.In()
 	p.P("srv := rpc.NewServer()")
-	p.P(`if err := srv.RegisterName("`, name, `", backend); err != nil {`)
+	p.P(`if err := srv.RegisterName("`, name, `", rpc`, name, `Backend{backend, interceptors}); err != nil {`)
+	p.In()
+	p.P("return err")
+	p.Out()
+	p.P("}")
+	p.P("for {")
+	p.In()
+	p.P("conn, err := l.Accept()")
+	p.P("if err != nil {")
+	p.In()
+	p.P("return err")
+	p.Out()
+	p.P("}")
+	p.P("go serve", name, "Conn(srv, conn, limits)")
+	p.Out()
+	p.P("}")
+	p.P(`panic("unreachable")`)
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// serve", name, "Conn runs srv on conn, recovering and logging any panic so")
+	p.P("// that one misbehaving connection can't take down the whole accept loop,")
+	p.P("// matching the robustness of net/rpc's own Server.Accept.")
+	p.P("func serve", name, "Conn(srv *rpc.Server, conn net.Conn, limits services.Limits) {")
+	p.In()
+	p.P("defer func() {")
+	p.In()
+	p.P("if r := recover(); r != nil {")
+	p.In()
+	p.P(`log.Printf("`, name, `: panic serving %s: %v", conn.RemoteAddr(), r)`)
+	p.Out()
+	p.P("}")
+	p.Out()
+	p.P("}()")
+	p.P("srv.ServeCodec(services.NewServerCodecWithLimits(conn, limits))")
+	p.Out()
+	p.P("}")
+}
+
+// generateStreamingService emits a service interface and client/server
+// wrappers built on services.StreamCodec rather than net/rpc, because
+// net/rpc has no notion of a call that outlives a single request/response.
+// Every method of such a service -- streaming or not -- is dispatched
+// through the same StreamCodec so that all of them can be multiplexed over
+// one connection.
+func (p *Plugin) generateStreamingService(svc *descriptor.ServiceDescriptorProto) {
+	name := generator.CamelCase(*svc.Name)
+
+	p.P("// ", name, "Server must be implemented by the object wrapped by the server;")
+	p.P("// it is served over a services.StreamCodec rather than net/rpc because")
+	p.P("// it has at least one streaming method.")
+	p.P("type ", name, "Server interface {")
+	p.In()
+	for _, m := range svc.Method {
+		method := generator.CamelCase(*m.Name)
+		iType := p.ObjectNamed(*m.InputType)
+		oType := p.ObjectNamed(*m.OutputType)
+		switch {
+		case m.GetClientStreaming():
+			p.P(method, "(stream ", name, "_", method, "Server) error")
+		case m.GetServerStreaming():
+			p.P(method, "(in *", p.TypeName(iType), ", stream ", name, "_", method, "Server) error")
+		default:
+			p.P(method, "(ctx context.Context, in *", p.TypeName(iType), ", out *", p.TypeName(oType), ") error")
+		}
+	}
+	p.Out()
+	p.P("}")
+	p.P()
+
+	p.P("// ", name, "Client is satisfied by the generated client and is used to call")
+	p.P("// the methods of ", name, "Server over a connection. ctx's deadline, if")
+	p.P("// any, is serialized into the request that opens each call, and the")
+	p.P("// call is canceled on the wire if ctx is done before it completes.")
+	p.P("type ", name, "Client interface {")
+	p.In()
+	for _, m := range svc.Method {
+		method := generator.CamelCase(*m.Name)
+		iType := p.TypeName(p.ObjectNamed(*m.InputType))
+		oType := p.TypeName(p.ObjectNamed(*m.OutputType))
+		switch {
+		case m.GetClientStreaming():
+			p.P(method, "(ctx context.Context) (", name, "_", method, "Client, error)")
+		case m.GetServerStreaming():
+			p.P(method, "(ctx context.Context, in *", iType, ") (", name, "_", method, "Client, error)")
+		default:
+			p.P(method, "(ctx context.Context, in *", iType, ", out *", oType, ") error")
+		}
+	}
+	p.Out()
+	p.P("}")
+	p.P()
+
+	for _, m := range svc.Method {
+		if !m.GetClientStreaming() && !m.GetServerStreaming() {
+			continue
+		}
+		method := generator.CamelCase(*m.Name)
+		iType := p.TypeName(p.ObjectNamed(*m.InputType))
+		oType := p.TypeName(p.ObjectNamed(*m.OutputType))
+		p.generateStreamTypes(name, method, iType, oType, m.GetClientStreaming(), m.GetServerStreaming())
+	}
+
+	p.P("// internal wrapper for type-safe RPC calling")
+	p.P("type rpc", name, "Client struct {")
+	p.In()
+	p.P("*services.StreamCodec")
+	p.Out()
+	p.P("}")
+	p.P()
+	for _, m := range svc.Method {
+		method := generator.CamelCase(*m.Name)
+		iType := p.TypeName(p.ObjectNamed(*m.InputType))
+		oType := p.TypeName(p.ObjectNamed(*m.OutputType))
+		switch {
+		case m.GetClientStreaming():
+			p.P("func (this rpc", name, "Client) ", method, "(ctx context.Context) (", name, "_", method, "Client, error) {")
+			p.In()
+			p.P(`stream, err := this.NewClientStream(ctx, "`, name, ".", method, `")`)
+			p.P("if err != nil {")
+			p.In()
+			p.P("return nil, err")
+			p.Out()
+			p.P("}")
+			p.P("return &", unexport(name), unexport(method), "Client{stream}, nil")
+			p.Out()
+			p.P("}")
+		case m.GetServerStreaming():
+			p.P("func (this rpc", name, "Client) ", method, "(ctx context.Context, in *", iType, ") (", name, "_", method, "Client, error) {")
+			p.In()
+			p.P(`stream, err := this.NewClientStreamWithRequest(ctx, "`, name, ".", method, `", in)`)
+			p.P("if err != nil {")
+			p.In()
+			p.P("return nil, err")
+			p.Out()
+			p.P("}")
+			p.P("if err := stream.CloseSend(); err != nil {")
+			p.In()
+			p.P("return nil, err")
+			p.Out()
+			p.P("}")
+			p.P("return &", unexport(name), unexport(method), "Client{stream}, nil")
+			p.Out()
+			p.P("}")
+		default:
+			p.P("func (this rpc", name, "Client) ", method, "(ctx context.Context, in *", iType, ", out *", oType, ") error {")
+			p.In()
+			p.P(`stream, err := this.NewClientStreamWithRequest(ctx, "`, name, ".", method, `", in)`)
+			p.P("if err != nil {")
+			p.In()
+			p.P("return err")
+			p.Out()
+			p.P("}")
+			p.P("if err := stream.CloseSend(); err != nil {")
+			p.In()
+			p.P("return err")
+			p.Out()
+			p.P("}")
+			p.P("return stream.RecvMsg(out)")
+			p.Out()
+			p.P("}")
+		}
+		p.P()
+	}
+
+	p.P("// New", name, "Client returns a ", name, "Client for calling the methods of")
+	p.P("// ", name, "Server over conn, multiplexing streaming and unary RPCs alike on")
+	p.P("// a single services.StreamCodec, and bounding message sizes to")
+	p.P("// services.DefaultLimits.")
+	p.P("func New", name, "Client(conn net.Conn) ", name, "Client {")
+	p.In()
+	p.P("return rpc", name, "Client{services.NewStreamCodec(conn, services.DefaultLimits)}")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Serve", name, " serves the given ", name, "Server backend implementation")
+	p.P("// on conn, blocking until conn is closed or a protocol error occurs.")
+	p.P("// interceptors wrap this service's non-streaming methods only --")
+	p.P("// services.ClientInterceptor/ServerInterceptor model a single")
+	p.P("// request/response call and so have no natural meaning for a method")
+	p.P("// that streams. Each method's handler recovers its own panic (StreamCodec")
+	p.P("// runs it in its own goroutine per call, outside of Serve", name, "'s own")
+	p.P("// stack), turning it into a STREAM_ERROR for that call instead of taking")
+	p.P("// down the whole connection.")
+	p.P("func Serve", name, "(conn net.Conn, backend ", name, "Server, interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P("codec := services.NewStreamCodec(conn, services.DefaultLimits)")
+	for _, m := range svc.Method {
+		method := generator.CamelCase(*m.Name)
+		iType := p.TypeName(p.ObjectNamed(*m.InputType))
+		oType := p.TypeName(p.ObjectNamed(*m.OutputType))
+		p.P(`codec.HandleFunc("`, name, ".", method, `", func(stream *services.ServerStream) (err error) {`)
+		p.In()
+		p.P("defer func() {")
+		p.In()
+		p.P("if r := recover(); r != nil {")
+		p.In()
+		p.P(`log.Printf("`, name, ".", method, `: panic: %v", r)`)
+		p.P(`err = fmt.Errorf("`, name, ".", method, `: panic: %v", r)`)
+		p.Out()
+		p.P("}")
+		p.Out()
+		p.P("}()")
+		switch {
+		case m.GetClientStreaming():
+			p.P("return backend.", method, "(&", unexport(name), unexport(method), "Server{stream})")
+		case m.GetServerStreaming():
+			p.P("in := new(", iType, ")")
+			p.P("if err := stream.RecvMsg(in); err != nil {")
+			p.In()
+			p.P("return err")
+			p.Out()
+			p.P("}")
+			p.P("return backend.", method, "(in, &", unexport(name), unexport(method), "Server{stream})")
+		default:
+			p.P("in := new(", iType, ")")
+			p.P("if err := stream.RecvMsg(in); err != nil {")
+			p.In()
+			p.P("return err")
+			p.Out()
+			p.P("}")
+			p.P("out := new(", oType, ")")
+			p.P(`if err := services.ChainServerInterceptors(interceptors, "`, name, ".", method, `", in, out, func() error {`)
+			p.In()
+			p.P("return backend.", method, "(stream.Context(), in, out)")
+			p.Out()
+			p.P("}); err != nil {")
+			p.In()
+			p.P("return err")
+			p.Out()
+			p.P("}")
+			p.P("return stream.SendMsg(out)")
+		}
+		p.Out()
+		p.P("})")
+	}
+	p.P("<-codec.Done()")
+	p.P("return nil")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Dial", name, " returns a ", name, "Client for calling the ", name, " service")
+	p.P("// at addr (TCP).")
+	p.P("func Dial", name, "(addr string) (", name, "Client, error) {")
+	p.In()
+	p.P(`conn, err := net.Dial("tcp", addr)`)
+	p.P("if err != nil {")
+	p.In()
+	p.P("return nil, err")
+	p.Out()
+	p.P("}")
+	p.P("return New", name, "Client(conn), nil")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Dial", name, "TLS is like Dial", name, " but dials addr over TLS using cfg.")
+	p.P("func Dial", name, "TLS(addr string, cfg *tls.Config) (", name, "Client, error) {")
+	p.In()
+	p.P(`conn, err := tls.Dial("tcp", addr, cfg)`)
+	p.P("if err != nil {")
+	p.In()
+	p.P("return nil, err")
+	p.Out()
+	p.P("}")
+	p.P("return New", name, "Client(conn), nil")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// ListenAndServe", name, " serves the given ", name, "Server backend")
+	p.P("// implementation on all connections accepted as a result of listening on")
+	p.P("// addr (TCP).")
+	p.P("func ListenAndServe", name, "(addr string, backend ", name, "Server, interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P(`clients, err := net.Listen("tcp", addr)`)
+	p.P("if err != nil {")
+	p.In()
+	p.P("return err")
+	p.Out()
+	p.P("}")
+	p.P("return Accept", name, "(clients, backend, interceptors...)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// ListenAndServe", name, "TLS is like ListenAndServe", name, " but accepts")
+	p.P("// only TLS connections configured by cfg.")
+	p.P("func ListenAndServe", name, "TLS(addr string, cfg *tls.Config, backend ", name, "Server, interceptors ...services.ServerInterceptor) error {")
+	p.In()
+	p.P(`clients, err := tls.Listen("tcp", addr, cfg)`)
+	p.P("if err != nil {")
 	p.In()
 	p.P("return err")
 	p.Out()
 	p.P("}")
+	p.P("return Accept", name, "(clients, backend, interceptors...)")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("// Accept", name, " serves the given ", name, "Server backend implementation")
+	p.P("// on every connection accepted from l. Unlike ListenAndServe", name, ", it")
+	p.P("// lets the caller supply its own net.Listener -- a unix socket, a")
+	p.P("// tls.Listener, a custom mux -- instead of dialing TCP itself.")
+	p.P("func Accept", name, "(l net.Listener, backend ", name, "Server, interceptors ...services.ServerInterceptor) error {")
+	p.In()
 	p.P("for {")
 	p.In()
-	p.P("conn, err := clients.Accept()")
+	p.P("conn, err := l.Accept()")
 	p.P("if err != nil {")
 	p.In()
 	p.P("return err")
 	p.Out()
 	p.P("}")
-	p.P("go srv.ServeCodec(services.NewServerCodec(conn))")
+	p.P("go serve", name, "Conn(conn, backend, interceptors...)")
 	p.Out()
 	p.P("}")
 	p.P(`panic("unreachable")`)
 	p.Out()
 	p.P("}")
+	p.P()
+	p.P("// serve", name, "Conn runs Serve", name, " on conn, recovering and logging")
+	p.P("// any panic so that one misbehaving connection can't take down the whole")
+	p.P("// accept loop, matching the robustness of net/rpc's own Server.Accept.")
+	p.P("func serve", name, "Conn(conn net.Conn, backend ", name, "Server, interceptors ...services.ServerInterceptor) {")
+	p.In()
+	p.P("defer func() {")
+	p.In()
+	p.P("if r := recover(); r != nil {")
+	p.In()
+	p.P(`log.Printf("`, name, `: panic serving %s: %v", conn.RemoteAddr(), r)`)
+	p.Out()
+	p.P("}")
+	p.Out()
+	p.P("}()")
+	p.P("if err := Serve", name, "(conn, backend, interceptors...); err != nil {")
+	p.In()
+	p.P(`log.Printf("`, name, `: %s: %v", conn.RemoteAddr(), err)`)
+	p.Out()
+	p.P("}")
+	p.Out()
+	p.P("}")
+}
+
+// generateStreamTypes emits the {name}_{method}Client and {name}_{method}Server
+// interfaces and their concrete wrappers around services.ClientStream and
+// services.ServerStream for a single streaming method.
+func (p *Plugin) generateStreamTypes(name, method, iType, oType string, clientStreaming, serverStreaming bool) {
+	serverIface := name + "_" + method + "Server"
+	clientIface := name + "_" + method + "Client"
+	serverImpl := unexport(name) + unexport(method) + "Server"
+	clientImpl := unexport(name) + unexport(method) + "Client"
+
+	p.P("// ", serverIface, " is the server side of the ", method, " streaming RPC.")
+	p.P("type ", serverIface, " interface {")
+	p.In()
+	if clientStreaming {
+		p.P("Recv() (*", iType, ", error)")
+	}
+	if serverStreaming {
+		p.P("Send(*", oType, ") error")
+	}
+	if clientStreaming && !serverStreaming {
+		p.P("SendAndClose(*", oType, ") error")
+	}
+	p.P("Context() context.Context")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("type ", serverImpl, " struct {")
+	p.In()
+	p.P("*services.ServerStream")
+	p.Out()
+	p.P("}")
+	p.P()
+	if clientStreaming {
+		p.P("func (x *", serverImpl, ") Recv() (*", iType, ", error) {")
+		p.In()
+		p.P("in := new(", iType, ")")
+		p.P("if err := x.RecvMsg(in); err != nil {")
+		p.In()
+		p.P("return nil, err")
+		p.Out()
+		p.P("}")
+		p.P("return in, nil")
+		p.Out()
+		p.P("}")
+		p.P()
+	}
+	if serverStreaming {
+		p.P("func (x *", serverImpl, ") Send(out *", oType, ") error {")
+		p.In()
+		p.P("return x.SendMsg(out)")
+		p.Out()
+		p.P("}")
+		p.P()
+	}
+	if clientStreaming && !serverStreaming {
+		p.P("func (x *", serverImpl, ") SendAndClose(out *", oType, ") error {")
+		p.In()
+		p.P("return x.SendMsg(out)")
+		p.Out()
+		p.P("}")
+		p.P()
+	}
+
+	p.P("// ", clientIface, " is the client side of the ", method, " streaming RPC.")
+	p.P("type ", clientIface, " interface {")
+	p.In()
+	if clientStreaming {
+		p.P("Send(*", iType, ") error")
+		p.P("CloseSend() error")
+	}
+	if clientStreaming && !serverStreaming {
+		p.P("CloseAndRecv() (*", oType, ", error)")
+	}
+	if serverStreaming {
+		p.P("Recv() (*", oType, ", error)")
+	}
+	p.P("Context() context.Context")
+	p.Out()
+	p.P("}")
+	p.P()
+	p.P("type ", clientImpl, " struct {")
+	p.In()
+	p.P("*services.ClientStream")
+	p.Out()
+	p.P("}")
+	p.P()
+	if clientStreaming {
+		p.P("func (x *", clientImpl, ") Send(in *", iType, ") error {")
+		p.In()
+		p.P("return x.SendMsg(in)")
+		p.Out()
+		p.P("}")
+		p.P()
+	}
+	if clientStreaming && !serverStreaming {
+		p.P("func (x *", clientImpl, ") CloseAndRecv() (*", oType, ", error) {")
+		p.In()
+		p.P("if err := x.CloseSend(); err != nil {")
+		p.In()
+		p.P("return nil, err")
+		p.Out()
+		p.P("}")
+		p.P("out := new(", oType, ")")
+		p.P("if err := x.RecvMsg(out); err != nil {")
+		p.In()
+		p.P("return nil, err")
+		p.Out()
+		p.P("}")
+		p.P("return out, nil")
+		p.Out()
+		p.P("}")
+		p.P()
+	}
+	if serverStreaming {
+		p.P("func (x *", clientImpl, ") Recv() (*", oType, ", error) {")
+		p.In()
+		p.P("out := new(", oType, ")")
+		p.P("if err := x.RecvMsg(out); err != nil {")
+		p.In()
+		p.P("return nil, err")
+		p.Out()
+		p.P("}")
+		p.P("return out, nil")
+		p.Out()
+		p.P("}")
+		p.P()
+	}
+}
+
+// unexport returns s with its leading rune lower-cased, for building
+// unexported concrete type names from exported ones (e.g. for a method's
+// stream wrapper types).
+func unexport(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+// ContextRequest is implemented by a generated {Name}{Method}In wrapper
+// type, pairing a method's request body with the context.Context
+// ReadRequestHeader built for it. A {Name}Server backend's ctx-taking
+// methods are reached through a generated adapter whose net/rpc-visible
+// argument type is one of these wrappers rather than the request type
+// itself, since net/rpc's reflection-based dispatch has no other way to
+// hand per-call metadata to the method it invokes.
+type ContextRequest interface {
+	// SetContext attaches ctx, built from the request's header, before the
+	// request body is unmarshaled into Body.
+	SetContext(ctx context.Context)
+
+	// Body returns the proto.Message to unmarshal the request into,
+	// allocating it on first call.
+	Body() proto.Message
+}
+
+// ContextCodec is implemented by the rpc.ClientCodec types in this package
+// (ClientCodec itself, under either of its framings) that can carry a
+// per-call deadline in the request header and accept an out-of-band
+// cancellation for a Seq already in flight. CallWithContext uses it when
+// the negotiated codec supports it.
+type ContextCodec interface {
+	rpc.ClientCodec
+	callWithDeadline(deadline time.Time, fn func()) (seq uint64)
+	cancel(seq uint64) error
+}
+
+// interceptedClientCodec is implemented by the rpc.ClientCodec types in
+// this package built with NewClientCodecWithOptions, whose
+// ClientInterceptor chain CallWithContext runs around the call.
+type interceptedClientCodec interface {
+	rpc.ClientCodec
+	clientInterceptors() []ClientInterceptor
+}
+
+// CallWithContext is like (*rpc.Client).Call, but honors ctx: if codec is a
+// ContextCodec (true for ProtoCodec and GRPCCodec, false for JSONCodec or a
+// third-party rpc.ClientCodec), ctx's deadline is serialized into the
+// request header, and a cancellation frame is sent if ctx is done before
+// the response arrives. Against a codec that isn't a ContextCodec,
+// CallWithContext still returns as soon as ctx is done -- it just has no
+// way to tell the server to stop working on the call. If codec was built
+// with NewClientCodecWithOptions and carries a ClientInterceptor chain, the
+// whole call (including its retries, under RetryInterceptor) is run inside
+// that chain.
+func CallWithContext(client *rpc.Client, codec rpc.ClientCodec, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := func() error { return callWithContext(client, codec, ctx, serviceMethod, args, reply) }
+	if ic, ok := codec.(interceptedClientCodec); ok {
+		if interceptors := ic.clientInterceptors(); len(interceptors) > 0 {
+			in, _ := args.(proto.Message)
+			out, _ := reply.(proto.Message)
+			return ChainClientInterceptors(interceptors, ctx, serviceMethod, in, out, call)
+		}
+	}
+	return call()
+}
+
+// callWithContext is CallWithContext without interceptor support, broken
+// out so CallWithContext can pass it to ChainClientInterceptors as the
+// innermost call.
+func callWithContext(client *rpc.Client, codec rpc.ClientCodec, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	cc, _ := codec.(ContextCodec)
+
+	var call *rpc.Call
+	send := func() { call = client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)) }
+
+	var seq uint64
+	if cc != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			seq = cc.callWithDeadline(deadline, send)
+		} else {
+			seq = cc.callWithDeadline(time.Time{}, send)
+		}
+	} else {
+		send()
+	}
+
+	select {
+	case <-ctx.Done():
+		if cc != nil {
+			cc.cancel(seq)
+		}
+		return ctx.Err()
+	case <-call.Done:
+		return call.Error
+	}
 }
 
 // ServerCodec implements the rpc.ServerCodec interface for generic protobufs.
@@ -129,56 +1021,106 @@ func (p *Plugin) GenerateService(svc *descriptor.ServiceDescriptorProto) {
 // decoding of a protocol buffer to the proto package and it uses a set header
 // that is the same regardless of the protobuf being used for the RPC.
 type ServerCodec struct {
-	r *bufio.Reader
-	w io.WriteCloser
+	r      *bufio.Reader
+	w      io.WriteCloser
+	limits Limits
+	frame  frameIO
+
+	mu      sync.Mutex
+	ctx     context.Context // context built for the request whose header was most recently read
+	cancels map[uint64]context.CancelFunc // one entry per in-flight request's Seq, regardless of whether it carries a deadline
 }
 
 // NewServerCodec returns a ServerCodec that communicates with the ClientCodec
-// on the other end of the given conn.
+// on the other end of the given conn, bounding message sizes to
+// DefaultLimits.
 func NewServerCodec(conn net.Conn) *ServerCodec {
-	return &ServerCodec{bufio.NewReader(conn), conn}
+	return NewServerCodecWithLimits(conn, DefaultLimits)
+}
+
+// NewServerCodecWithLimits is like NewServerCodec but lets the caller bound
+// the size of the messages the codec will allocate for, so a peer can't OOM
+// the process by declaring an enormous message size.
+func NewServerCodecWithLimits(conn net.Conn, limits Limits) *ServerCodec {
+	return newServerCodec(bufio.NewReader(conn), conn, limits, uvarintFrame)
+}
+
+// newServerCodec builds a ServerCodec around an already-constructed reader,
+// so that a Codec negotiated by NegotiateServerCodec can keep reading from
+// the same buffered reader used to read the wire.Hello that selected it
+// instead of losing whatever it had already buffered.
+func newServerCodec(r *bufio.Reader, w io.WriteCloser, limits Limits, frame frameIO) *ServerCodec {
+	return &ServerCodec{r: r, w: w, limits: limits, frame: frame, cancels: make(map[uint64]context.CancelFunc)}
 }
 
 // ReadRequestHeader reads the header protobuf (which is prefixed by a uvarint
 // indicating its size) from the connection, decodes it, and stores the fields
-// in the given request.
+// in the given request. A frame with Cancel set is not itself a request: it
+// cancels the context built for the call named by its Seq, and this reads on
+// to find the next actual request.
 func (s *ServerCodec) ReadRequestHeader(req *rpc.Request) error {
-	size, err := binary.ReadUvarint(s.r)
-	if err != nil {
-		return err
-	}
-	// TODO max size?
-	message := make([]byte, size)
-	if _, err := io.ReadFull(s.r, message); err != nil {
-		return err
-	}
-	var header wire.Header
-	if err := proto.Unmarshal(message, &header); err != nil {
-		return err
-	}
-	if header.Method == nil {
-		return fmt.Errorf("header missing method: %s", header)
+	for {
+		message, err := s.frame.read(s.r, s.w, s.limits)
+		if err != nil {
+			return err
+		}
+		var header wire.Header
+		if err := proto.Unmarshal(message, &header); err != nil {
+			return err
+		}
+		if header.GetCancel() {
+			s.cancel(header.GetSeq())
+			continue
+		}
+		if header.Method == nil {
+			return fmt.Errorf("header missing method: %s", header)
+		}
+		if header.Seq == nil {
+			return fmt.Errorf("header missing seq: %s", header)
+		}
+
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if header.DeadlineUnixNano != nil {
+			ctx, cancel = context.WithDeadline(context.Background(), time.Unix(0, header.GetDeadlineUnixNano()))
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		s.mu.Lock()
+		s.cancels[*header.Seq] = cancel
+		s.mu.Unlock()
+		s.ctx = ctx
+
+		req.ServiceMethod = *header.Method
+		req.Seq = *header.Seq
+		return nil
 	}
-	if header.Seq == nil {
-		return fmt.Errorf("header missing seq: %s", header)
+}
+
+// cancel invokes and forgets the CancelFunc registered for seq, if any.
+func (s *ServerCodec) cancel(seq uint64) {
+	s.mu.Lock()
+	cancel, ok := s.cancels[seq]
+	delete(s.cancels, seq)
+	s.mu.Unlock()
+	if ok {
+		cancel()
 	}
-	req.ServiceMethod = *header.Method
-	req.Seq = *header.Seq
-	return nil
 }
 
 // ReadRequestBody reads a uvarint from the connection and decodes that many
 // subsequent bytes into the given protobuf (which should be a pointer to a
-// struct that is generated by the proto package).
+// struct that is generated by the proto package). If pb also implements
+// ContextRequest, as the generated {Name}{Method}In wrappers do, it is first
+// handed the context ReadRequestHeader built for this request.
 func (s *ServerCodec) ReadRequestBody(pb interface{}) error {
-	size, err := binary.ReadUvarint(s.r)
+	message, err := s.frame.read(s.r, s.w, s.limits)
 	if err != nil {
 		return err
 	}
-	// TODO max size?
-	message := make([]byte, size)
-	if _, err := io.ReadFull(s.r, message); err != nil {
-		return err
+	if cr, ok := pb.(ContextRequest); ok {
+		cr.SetContext(s.ctx)
+		return proto.Unmarshal(message, cr.Body())
 	}
 	return proto.Unmarshal(message, pb)
 }
@@ -189,13 +1131,9 @@ func (s *ServerCodec) ReadRequestBody(pb interface{}) error {
 // having size zero and is not sent.
 func (s *ServerCodec) WriteResponse(resp *rpc.Response, pb interface{}) error {
 	var header wire.Header
-	var size []byte
 	var data []byte
 	var err error
 
-	// Allocate enough space for the biggest size
-	size = make([]byte, binary.MaxVarintLen64)
-
 	// Write the header
 	if resp.Error != "" {
 		header.Error = &resp.Error
@@ -205,16 +1143,15 @@ func (s *ServerCodec) WriteResponse(resp *rpc.Response, pb interface{}) error {
 	if data, err = proto.Marshal(&header); err != nil {
 		return err
 	}
-	size = size[:binary.PutUvarint(size, uint64(len(data)))]
-	if _, err = s.w.Write(size); err != nil {
-		return err
-	}
-	if _, err = s.w.Write(data); err != nil {
+	if err = s.frame.write(s.w, data); err != nil {
 		return err
 	}
 
+	// The context built for this call is done with once its response is
+	// written.
+	s.cancel(resp.Seq)
+
 	// Write the proto
-	size = size[:cap(size)]
 	if _, invalid := pb.(rpc.InvalidRequest); invalid {
 		data = nil
 	} else {
@@ -222,16 +1159,7 @@ func (s *ServerCodec) WriteResponse(resp *rpc.Response, pb interface{}) error {
 			return err
 		}
 	}
-	size = size[:binary.PutUvarint(size, uint64(len(data)))]
-	if _, err = s.w.Write(size); err != nil {
-		return err
-	}
-	if _, err = s.w.Write(data); err != nil {
-		return err
-	}
-
-	// All done
-	return nil
+	return s.frame.write(s.w, data)
 }
 
 // Close closes the underlying conneciton.
@@ -244,71 +1172,115 @@ func (s *ServerCodec) Close() error {
 // encoding of a protocol buffer to the proto package and it uses a set header
 // that is the same regardless of the protobuf being used for the RPC.
 type ClientCodec struct {
-	r *bufio.Reader
-	w io.WriteCloser
+	r      *bufio.Reader
+	w      io.WriteCloser
+	limits Limits
+	frame  frameIO
+
+	// mu is held by callWithDeadline for the whole of the synchronous
+	// client.Go call it wraps, so the deadline it records is the one
+	// WriteRequest picks up for that call's request, and so a concurrent
+	// cancel can't interleave its frame with a WriteRequest in progress.
+	mu              sync.Mutex
+	pendingDeadline time.Time
+	lastSeq         uint64
+
+	// interceptors, if set by NewClientCodecWithOptions, wraps every call
+	// CallWithContext makes through this codec.
+	interceptors []ClientInterceptor
+}
+
+// clientInterceptors implements the unexported interceptedClientCodec
+// interface CallWithContext checks for.
+func (c *ClientCodec) clientInterceptors() []ClientInterceptor {
+	return c.interceptors
 }
 
 // NewClientCodec returns a ClientCodec for communicating with the ServerCodec
-// on the other end of the conn.
+// on the other end of the conn, bounding message sizes to DefaultLimits.
 func NewClientCodec(conn net.Conn) *ClientCodec {
-	return &ClientCodec{bufio.NewReader(conn), conn}
+	return NewClientCodecWithLimits(conn, DefaultLimits)
+}
+
+// NewClientCodecWithLimits is like NewClientCodec but lets the caller bound
+// the size of the messages the codec will allocate for, so a peer can't OOM
+// the process by declaring an enormous message size.
+func NewClientCodecWithLimits(conn net.Conn, limits Limits) *ClientCodec {
+	return newClientCodec(bufio.NewReader(conn), conn, limits, uvarintFrame)
+}
+
+// newClientCodec builds a ClientCodec around an already-constructed reader
+// and a choice of framing, so other Codecs can share the implementation.
+func newClientCodec(r *bufio.Reader, w io.WriteCloser, limits Limits, frame frameIO) *ClientCodec {
+	return &ClientCodec{r: r, w: w, limits: limits, frame: frame}
 }
 
 // WriteRequest writes the appropriate header protobuf and the given protobuf
-// to the connection (each prefixed with a uvarint indicating its size).
+// to the connection (each prefixed with a uvarint indicating its size). If a
+// deadline is pending (set by callWithDeadline for this call), it's attached
+// to the header and cleared.
 func (c *ClientCodec) WriteRequest(req *rpc.Request, pb interface{}) error {
 	var header wire.Header
-	var size []byte
 	var data []byte
 	var err error
 
-	// Allocate enough space for the biggest size
-	size = make([]byte, binary.MaxVarintLen64)
-
 	// Write the header
 	header.Method = &req.ServiceMethod
 	header.Seq = &req.Seq
-	if data, err = proto.Marshal(&header); err != nil {
-		return err
+	if !c.pendingDeadline.IsZero() {
+		nanos := c.pendingDeadline.UnixNano()
+		header.DeadlineUnixNano = &nanos
+		c.pendingDeadline = time.Time{}
 	}
-	size = size[:binary.PutUvarint(size, uint64(len(data)))]
-	if _, err = c.w.Write(size); err != nil {
+	c.lastSeq = req.Seq
+	if data, err = proto.Marshal(&header); err != nil {
 		return err
 	}
-	if _, err = c.w.Write(data); err != nil {
+	if err = c.frame.write(c.w, data); err != nil {
 		return err
 	}
 
 	// Write the proto
-	size = size[:cap(size)]
 	if data, err = proto.Marshal(pb); err != nil {
 		return err
 	}
-	size = size[:binary.PutUvarint(size, uint64(len(data)))]
-	if _, err = c.w.Write(size); err != nil {
-		return err
-	}
-	if _, err = c.w.Write(data); err != nil {
+	return c.frame.write(c.w, data)
+}
+
+// callWithDeadline records deadline as the pending deadline for the next
+// WriteRequest call, invokes fn (expected to synchronously trigger exactly
+// one such call, e.g. via (*rpc.Client).Go), and returns the Seq that call
+// used. It implements ContextCodec.
+func (c *ClientCodec) callWithDeadline(deadline time.Time, fn func()) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pendingDeadline = deadline
+	fn()
+	return c.lastSeq
+}
+
+// cancel sends a standalone Header naming seq and Cancel, with no body,
+// asking the peer to cancel the context it built for that call. It
+// implements ContextCodec.
+func (c *ClientCodec) cancel(seq uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := wire.Header{Seq: &seq, Cancel: proto.Bool(true)}
+	data, err := proto.Marshal(&header)
+	if err != nil {
 		return err
 	}
-
-	// All done
-	return nil
+	return c.frame.write(c.w, data)
 }
 
 // ReadResponseHeader reads the header protobuf (which is prefixed by a uvarint
 // indicating its size) from the connection, decodes it, and stores the fields
 // in the given request.
 func (c *ClientCodec) ReadResponseHeader(resp *rpc.Response) error {
-	size, err := binary.ReadUvarint(c.r)
+	message, err := c.frame.read(c.r, c.w, c.limits)
 	if err != nil {
 		return err
 	}
-	// TODO max size?
-	message := make([]byte, size)
-	if _, err := io.ReadFull(c.r, message); err != nil {
-		return err
-	}
 	var header wire.Header
 	if err := proto.Unmarshal(message, &header); err != nil {
 		return err
@@ -333,19 +1305,13 @@ func (c *ClientCodec) ReadResponseHeader(resp *rpc.Response) error {
 // is zero, nothing is done (this indicates an error condition, which was
 // encapsulated in the header)
 func (c *ClientCodec) ReadResponseBody(pb interface{}) error {
-	size, err := binary.ReadUvarint(c.r)
+	message, err := c.frame.read(c.r, c.w, c.limits)
 	if err != nil {
 		return err
 	}
-	if size == 0 || pb == nil {
+	if len(message) == 0 || pb == nil {
 		return nil
 	}
-
-	// TODO max size?
-	message := make([]byte, size)
-	if _, err := io.ReadFull(c.r, message); err != nil {
-		return err
-	}
 	return proto.Unmarshal(message, pb)
 }
 
@@ -353,7 +1319,3 @@ func (c *ClientCodec) ReadResponseBody(pb interface{}) error {
 func (c *ClientCodec) Close() error {
 	return c.w.Close()
 }
-
-// BUG: The server/client don't do a sanity check on the size of the proto
-// before reading it, so it's possible to maliciously instruct the
-// client/server to allocate too much memory.
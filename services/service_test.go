@@ -0,0 +1,93 @@
+package services
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"github.com/kylelemons/go-rpcgen/services/wire"
+)
+
+// writeTestRequest marshals h and writes it, followed by a body, the way a
+// real client request arrives on the wire. The body is itself a marshaled
+// wire.Header only because it's a convenient stand-in message; its content
+// isn't inspected by these tests. It must not be zero-length: on a net.Pipe,
+// io.ReadFull never calls Read for a zero-length buffer, so a literal empty
+// body would leave this write's rendezvous with ReadRequestBody unmatched.
+func writeTestRequest(t *testing.T, w net.Conn, h *wire.Header) {
+	t.Helper()
+	writeTestHeader(t, w, h)
+	body, err := proto.Marshal(&wire.Header{Method: h.Method})
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	if err := writeUvarintMessage(w, body); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+}
+
+// writeTestHeader marshals h and writes it alone, the way ClientCodec.cancel
+// sends a standalone Cancel frame with no accompanying body.
+func writeTestHeader(t *testing.T, w net.Conn, h *wire.Header) {
+	t.Helper()
+	hdata, err := proto.Marshal(h)
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	if err := writeUvarintMessage(w, hdata); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+}
+
+// TestServerCodecCancelWithoutDeadline is a regression test: a Cancel frame
+// must be able to cancel a request's context even when that request never
+// carried a deadline, since context.WithCancel(parent) (no deadline at all)
+// is the common case for a caller that only wants to give up early, not one
+// bounded by a fixed timeout.
+func TestServerCodecCancelWithoutDeadline(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	sc := NewServerCodec(sconn)
+
+	seq1, seq2 := uint64(1), uint64(2)
+	method := "Test.Echo"
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeTestRequest(t, cconn, &wire.Header{Method: &method, Seq: &seq1, Type: wire.Header_REQUEST.Enum()})
+		writeTestHeader(t, cconn, &wire.Header{Seq: &seq1, Cancel: proto.Bool(true)})
+		writeTestRequest(t, cconn, &wire.Header{Method: &method, Seq: &seq2, Type: wire.Header_REQUEST.Enum()})
+	}()
+
+	var req rpc.Request
+	if err := sc.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("ReadRequestHeader: %v", err)
+	}
+	ctx := sc.ctx
+	if ctx.Done() == nil {
+		t.Fatal("context built for a request with no deadline has a nil Done channel, so a Cancel frame for it could never be observed")
+	}
+	if err := sc.ReadRequestBody(new(wire.Header)); err != nil {
+		t.Fatalf("ReadRequestBody: %v", err)
+	}
+
+	var req2 rpc.Request
+	if err := sc.ReadRequestHeader(&req2); err != nil {
+		t.Fatalf("ReadRequestHeader: %v", err)
+	}
+	if err := sc.ReadRequestBody(new(wire.Header)); err != nil {
+		t.Fatalf("ReadRequestBody: %v", err)
+	}
+	<-done
+
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("Cancel frame for a deadline-less request did not cancel its context")
+	}
+}
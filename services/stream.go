@@ -0,0 +1,454 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"github.com/kylelemons/go-rpcgen/services/wire"
+)
+
+// StreamHandler is the backend-side entry point for a streaming RPC.  It is
+// invoked in its own goroutine for each incoming request frame whose method
+// matches the name it was registered under, and should run for as long as
+// the stream is open, using stream's Send/Recv to exchange STREAM_MSG
+// frames with the peer.
+type StreamHandler func(stream *ServerStream) error
+
+// StreamCodec multiplexes unary and streaming RPCs for a single connection.
+// Unlike ServerCodec/ClientCodec, which hand every frame straight to
+// net/rpc, StreamCodec understands wire.Header's FrameType: it recognizes
+// STREAM_MSG/STREAM_END/STREAM_ERROR frames tagged with a request's Seq and
+// routes them to that request's ClientStream or ServerStream instead of
+// treating them as an ordinary request or response.  GenerateService uses
+// it instead of ServerCodec/ClientCodec for any service with at least one
+// streaming method.
+type StreamCodec struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	limits Limits
+	frame  frameIO
+
+	wmu sync.Mutex // serializes writes to conn
+
+	seq uint64 // next client-initiated Seq, incremented atomically
+
+	mu       sync.Mutex
+	handlers map[string]StreamHandler
+	streams  map[uint64]*streamState
+
+	readErr error
+	closeCh chan struct{}
+}
+
+// streamState is the per-Seq bookkeeping shared by the read loop and the
+// ClientStream/ServerStream the application is calling Send/Recv on.
+type streamState struct {
+	in     chan streamFrame
+	closed bool // true once a STREAM_END/STREAM_ERROR frame (or EOF) was delivered
+
+	// cancel, if non-nil, is the CancelFunc for the context.Context built
+	// for a server-dispatched stream; cancelSeq invokes it when a Cancel
+	// frame for this Seq arrives. It is nil for a client-initiated stream.
+	cancel context.CancelFunc
+
+	// clientInitiated is true for a streamState created by NewClientStream
+	// or NewClientStreamWithRequest. deliver uses it to free the entry as
+	// soon as the peer's STREAM_END/STREAM_ERROR is delivered, since unlike
+	// a server-dispatched stream's entry -- kept around so a later Cancel
+	// frame still finds its CancelFunc -- a client-initiated entry has no
+	// cancel to preserve and nothing else to wait for.
+	clientInitiated bool
+}
+
+type streamFrame struct {
+	typ  wire.Header_FrameType
+	data []byte
+	err  string
+}
+
+// streamFrameBuffer is how many undelivered frames a single stream will
+// buffer before the read loop blocks waiting for the application to drain
+// it with Recv.  Blocking the read loop briefly is preferable to growing
+// memory without bound on a slow consumer; it does mean a very slow stream
+// can back up other streams sharing the same connection.
+const streamFrameBuffer = 64
+
+// NewStreamCodec returns a StreamCodec for conn, bounding message sizes to
+// limits and starting the background goroutine that demultiplexes incoming
+// frames.  Call HandleFunc before the first frame arrives to register
+// backend methods if conn is being used to serve a backend.
+func NewStreamCodec(conn net.Conn, limits Limits) *StreamCodec {
+	sc := &StreamCodec{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		limits:   limits,
+		frame:    uvarintFrame,
+		handlers: make(map[string]StreamHandler),
+		streams:  make(map[uint64]*streamState),
+		closeCh:  make(chan struct{}),
+	}
+	go sc.readLoop()
+	return sc
+}
+
+// HandleFunc registers h to be invoked for each new stream opened against
+// method (a "Service.Method" name, matching req.ServiceMethod).
+func (sc *StreamCodec) HandleFunc(method string, h StreamHandler) {
+	sc.mu.Lock()
+	sc.handlers[method] = h
+	sc.mu.Unlock()
+}
+
+// Close closes the underlying connection and fails any streams still
+// waiting on a Recv.
+func (sc *StreamCodec) Close() error {
+	return sc.conn.Close()
+}
+
+// Done returns a channel that's closed once the read loop exits, whether
+// because the connection was closed or because a protocol error occurred.
+// Serve{Name} blocks on it so it returns when the peer disconnects, the way
+// rpc.ServeCodec does for unary-only services.
+func (sc *StreamCodec) Done() <-chan struct{} {
+	return sc.closeCh
+}
+
+func (sc *StreamCodec) writeHeader(h *wire.Header, data []byte) error {
+	hdata, err := proto.Marshal(h)
+	if err != nil {
+		return err
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if err := sc.frame.write(sc.conn, hdata); err != nil {
+		return err
+	}
+	return sc.frame.write(sc.conn, data)
+}
+
+// NewClientStream opens a new stream for method and returns the ClientStream
+// the caller uses to Send/Recv on it. If ctx carries a deadline, it is
+// serialized into the REQUEST frame that opens the stream; if ctx is
+// canceled before the stream ends, a Cancel frame bearing the stream's Seq
+// is sent so the server can abort its handler.
+func (sc *StreamCodec) NewClientStream(ctx context.Context, method string) (*ClientStream, error) {
+	seq := atomic.AddUint64(&sc.seq, 1)
+	state := &streamState{in: make(chan streamFrame, streamFrameBuffer), clientInitiated: true}
+
+	sc.mu.Lock()
+	sc.streams[seq] = state
+	sc.mu.Unlock()
+
+	h := &wire.Header{Method: &method, Seq: &seq, Type: wire.Header_REQUEST.Enum()}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.DeadlineUnixNano = proto.Int64(deadline.UnixNano())
+	}
+	if err := sc.writeHeader(h, nil); err != nil {
+		return nil, err
+	}
+	sc.watchCancel(ctx, seq)
+	return &ClientStream{codec: sc, seq: seq, state: state, ctx: ctx}, nil
+}
+
+// NewClientStreamWithRequest is like NewClientStream, but piggybacks req's
+// marshaled bytes on the REQUEST frame that opens the stream, the way a
+// plain unary call or the initial message of a server-streaming RPC does.
+func (sc *StreamCodec) NewClientStreamWithRequest(ctx context.Context, method string, req interface{}) (*ClientStream, error) {
+	data, err := proto.Marshal(req.(proto.Message))
+	if err != nil {
+		return nil, err
+	}
+
+	seq := atomic.AddUint64(&sc.seq, 1)
+	state := &streamState{in: make(chan streamFrame, streamFrameBuffer), clientInitiated: true}
+
+	sc.mu.Lock()
+	sc.streams[seq] = state
+	sc.mu.Unlock()
+
+	h := &wire.Header{Method: &method, Seq: &seq, Type: wire.Header_REQUEST.Enum()}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.DeadlineUnixNano = proto.Int64(deadline.UnixNano())
+	}
+	if err := sc.writeHeader(h, data); err != nil {
+		return nil, err
+	}
+	sc.watchCancel(ctx, seq)
+	return &ClientStream{codec: sc, seq: seq, state: state, ctx: ctx}, nil
+}
+
+// watchCancel spawns a goroutine that sends a Cancel frame for seq when ctx
+// is done, unless ctx can never be done (e.g. context.Background()).
+func (sc *StreamCodec) watchCancel(ctx context.Context, seq uint64) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		sc.writeHeader(&wire.Header{Seq: &seq, Cancel: proto.Bool(true)}, nil)
+	}()
+}
+
+// readLoop is the single reader of sc.conn.  It runs for the lifetime of
+// the StreamCodec, dispatching each frame either to a newly-spawned
+// StreamHandler (for an incoming REQUEST) or to the streamState registered
+// for its Seq (for STREAM_MSG/STREAM_END/STREAM_ERROR).
+func (sc *StreamCodec) readLoop() {
+	defer close(sc.closeCh)
+	for {
+		hdata, err := sc.frame.read(sc.r, sc.conn, sc.limits)
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+		var h wire.Header
+		if err := proto.Unmarshal(hdata, &h); err != nil {
+			sc.fail(err)
+			return
+		}
+		data, err := sc.frame.read(sc.r, sc.conn, sc.limits)
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+
+		if h.GetCancel() {
+			sc.cancelSeq(h.GetSeq())
+			continue
+		}
+
+		switch h.GetType() {
+		case wire.Header_REQUEST:
+			sc.dispatch(h.GetMethod(), h.GetSeq(), h.DeadlineUnixNano, data)
+		case wire.Header_STREAM_MSG:
+			sc.deliver(h.GetSeq(), streamFrame{typ: wire.Header_STREAM_MSG, data: data})
+		case wire.Header_STREAM_END:
+			sc.deliver(h.GetSeq(), streamFrame{typ: wire.Header_STREAM_END})
+		case wire.Header_STREAM_ERROR:
+			sc.deliver(h.GetSeq(), streamFrame{typ: wire.Header_STREAM_ERROR, err: h.GetError()})
+		default:
+			sc.fail(fmt.Errorf("services: unexpected frame type %s on stream connection", h.GetType()))
+			return
+		}
+	}
+}
+
+// dispatch starts the StreamHandler registered for method, if any, handing
+// it a fresh ServerStream.  An unrecognized method fails the new stream
+// immediately with a STREAM_ERROR rather than the whole connection, as does
+// a handler that panics (see runStreamHandler). The ServerStream's Context
+// is built with context.WithDeadline if deadlineUnixNano is set and with
+// context.WithCancel otherwise, and the resulting CancelFunc is invoked by
+// cancelSeq if a Cancel frame for seq arrives, or once the handler returns,
+// whichever comes first.
+func (sc *StreamCodec) dispatch(method string, seq uint64, deadlineUnixNano *int64, body []byte) {
+	sc.mu.Lock()
+	h, ok := sc.handlers[method]
+	sc.mu.Unlock()
+	if !ok {
+		sc.writeHeader(&wire.Header{Seq: &seq, Type: wire.Header_STREAM_ERROR.Enum(), Error: proto.String(fmt.Sprintf("services: unknown method %q", method))}, nil)
+		return
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadlineUnixNano != nil {
+		ctx, cancel = context.WithDeadline(context.Background(), time.Unix(0, *deadlineUnixNano))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	state := &streamState{in: make(chan streamFrame, streamFrameBuffer), cancel: cancel}
+	sc.mu.Lock()
+	sc.streams[seq] = state
+	sc.mu.Unlock()
+
+	if len(body) > 0 {
+		state.in <- streamFrame{typ: wire.Header_STREAM_MSG, data: body}
+	}
+
+	stream := &ServerStream{codec: sc, method: method, seq: seq, state: state, ctx: ctx}
+	go func() {
+		err := runStreamHandler(method, h, stream)
+		if err != nil {
+			sc.writeHeader(&wire.Header{Seq: &seq, Type: wire.Header_STREAM_ERROR.Enum(), Error: proto.String(err.Error())}, nil)
+		} else {
+			sc.writeHeader(&wire.Header{Seq: &seq, Type: wire.Header_STREAM_END.Enum()}, nil)
+		}
+		sc.mu.Lock()
+		delete(sc.streams, seq)
+		sc.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	}()
+}
+
+// runStreamHandler calls h(stream), recovering a panic from it and reporting
+// it as an error instead, the way a method's own error return would be
+// reported -- so a panicking handler fails only its own call with a
+// STREAM_ERROR rather than taking down the whole connection's read loop.
+func runStreamHandler(method string, h StreamHandler, stream *ServerStream) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("services: panic in stream handler for %q: %v", method, r)
+			err = fmt.Errorf("services: panic in stream handler for %q: %v", method, r)
+		}
+	}()
+	return h(stream)
+}
+
+// cancelSeq invokes the CancelFunc stored for seq, if any, so the handler
+// running that stream's context can abort. It is a no-op for a
+// client-initiated stream (which has no CancelFunc) or one that has already
+// finished.
+func (sc *StreamCodec) cancelSeq(seq uint64) {
+	sc.mu.Lock()
+	state, ok := sc.streams[seq]
+	sc.mu.Unlock()
+	if !ok || state.cancel == nil {
+		return
+	}
+	state.cancel()
+}
+
+// deliver routes a frame belonging to seq to its streamState, if it's still
+// registered; frames for an already-finished stream are silently dropped.
+// A STREAM_END/STREAM_ERROR is the peer's last word on seq, so if state is
+// client-initiated -- meaning the peer, not us, decides when seq is done --
+// deliver also frees sc.streams[seq] here; nothing else will.
+// (A server-dispatched stream's entry is instead freed once its handler
+// goroutine returns, in dispatch, since it must stay reachable for a Cancel
+// frame to find its CancelFunc for as long as that handler is running.)
+func (sc *StreamCodec) deliver(seq uint64, f streamFrame) {
+	sc.mu.Lock()
+	state, ok := sc.streams[seq]
+	if ok && (f.typ == wire.Header_STREAM_END || f.typ == wire.Header_STREAM_ERROR) {
+		state.closed = true
+		if state.clientInitiated {
+			delete(sc.streams, seq)
+		}
+	}
+	sc.mu.Unlock()
+	if !ok {
+		return
+	}
+	state.in <- f
+}
+
+// fail records a fatal read-loop error so pending Recv calls stop blocking.
+func (sc *StreamCodec) fail(err error) {
+	sc.mu.Lock()
+	sc.readErr = err
+	for _, state := range sc.streams {
+		state.closed = true
+		close(state.in)
+	}
+	sc.mu.Unlock()
+}
+
+// recvFrame is shared by ClientStream.RecvMsg and ServerStream.RecvMsg: it reads
+// the next STREAM_MSG for state, or turns STREAM_END/STREAM_ERROR/channel
+// closure into io.EOF/the carried error.
+func recvFrame(sc *StreamCodec, state *streamState, msg interface{}) error {
+	f, ok := <-state.in
+	if !ok {
+		sc.mu.Lock()
+		err := sc.readErr
+		sc.mu.Unlock()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	switch f.typ {
+	case wire.Header_STREAM_END:
+		return io.EOF
+	case wire.Header_STREAM_ERROR:
+		return fmt.Errorf("%s", f.err)
+	default:
+		return proto.Unmarshal(f.data, msg.(proto.Message))
+	}
+}
+
+// ClientStream is the client side of a streaming RPC.  The concrete
+// {Service}_{Method}Client types GenerateService emits wrap a ClientStream
+// to expose typed Send/Recv methods.
+type ClientStream struct {
+	codec *StreamCodec
+	seq   uint64
+	state *streamState
+	ctx   context.Context
+}
+
+// SendMsg marshals msg as a STREAM_MSG frame for this stream.
+func (cs *ClientStream) SendMsg(msg interface{}) error {
+	data, err := proto.Marshal(msg.(proto.Message))
+	if err != nil {
+		return err
+	}
+	return cs.codec.writeHeader(&wire.Header{Seq: &cs.seq, Type: wire.Header_STREAM_MSG.Enum()}, data)
+}
+
+// RecvMsg blocks until the next message the server sends on this stream is
+// available and unmarshals it into msg, or returns io.EOF once the server
+// has sent a STREAM_END.
+func (cs *ClientStream) RecvMsg(msg interface{}) error {
+	return recvFrame(cs.codec, cs.state, msg)
+}
+
+// CloseSend half-closes the stream, telling the server no more client
+// messages are coming.  RecvMsg keeps returning the server's messages
+// afterwards, until the server ends the stream.
+func (cs *ClientStream) CloseSend() error {
+	return cs.codec.writeHeader(&wire.Header{Seq: &cs.seq, Type: wire.Header_STREAM_END.Enum()}, nil)
+}
+
+// Context returns the context this stream was opened with, whose deadline
+// (if any) was serialized into the REQUEST frame that opened it.
+func (cs *ClientStream) Context() context.Context {
+	return cs.ctx
+}
+
+// ServerStream is the server side of a streaming RPC, passed to the
+// StreamHandler registered for the method.
+type ServerStream struct {
+	codec  *StreamCodec
+	method string
+	seq    uint64
+	state  *streamState
+	ctx    context.Context
+}
+
+// SendMsg marshals msg as a STREAM_MSG frame for this stream.
+func (ss *ServerStream) SendMsg(msg interface{}) error {
+	data, err := proto.Marshal(msg.(proto.Message))
+	if err != nil {
+		return err
+	}
+	return ss.codec.writeHeader(&wire.Header{Seq: &ss.seq, Type: wire.Header_STREAM_MSG.Enum()}, data)
+}
+
+// RecvMsg blocks until the next message the client sends on this stream is
+// available and unmarshals it into msg, or returns io.EOF once the client
+// has called CloseSend.
+func (ss *ServerStream) RecvMsg(msg interface{}) error {
+	return recvFrame(ss.codec, ss.state, msg)
+}
+
+// Context returns the context built for this stream: a context.WithCancel
+// if the REQUEST frame that opened it carried no deadline, or a
+// context.WithDeadline derived from one that it did, either way canceled
+// when the client sends a Cancel frame for this stream's Seq.
+func (ss *ServerStream) Context() context.Context {
+	return ss.ctx
+}
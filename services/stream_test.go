@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"github.com/kylelemons/go-rpcgen/services/wire"
+)
+
+// echoStreamCodecs wires up a client/server StreamCodec pair over an
+// in-memory connection, with the server echoing Method back on
+// "Test.Echo" the way a unary-over-stream call does.
+func echoStreamCodecs(t *testing.T) (client, server *StreamCodec) {
+	t.Helper()
+	cconn, sconn := net.Pipe()
+	server = NewStreamCodec(sconn, DefaultLimits)
+	server.HandleFunc("Test.Echo", func(stream *ServerStream) error {
+		in := new(wire.Header)
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		return stream.SendMsg(&wire.Header{Method: in.Method})
+	})
+	client = NewStreamCodec(cconn, DefaultLimits)
+	return client, server
+}
+
+func echoOnce(t *testing.T, client *StreamCodec, method string) {
+	t.Helper()
+	stream, err := client.NewClientStreamWithRequest(context.Background(), "Test.Echo", &wire.Header{Method: proto.String(method)})
+	if err != nil {
+		t.Fatalf("NewClientStreamWithRequest: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	out := new(wire.Header)
+	if err := stream.RecvMsg(out); err != nil {
+		t.Fatalf("RecvMsg: %v", err)
+	}
+	if out.GetMethod() != method {
+		t.Fatalf("got method %q, want %q", out.GetMethod(), method)
+	}
+}
+
+// streamCount waits up to a short timeout for client.streams to reach want
+// entries, since deliver frees a finished client-initiated stream's entry
+// from the read loop goroutine, not from RecvMsg itself.
+func streamCount(t *testing.T, client *StreamCodec, want int) {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		client.mu.Lock()
+		got := len(client.streams)
+		client.mu.Unlock()
+		if got == want {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("client.streams has %d entries, want %d", got, want)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// TestStreamCodecRoundTrip covers a basic unary-over-stream call: it should
+// see the request it sent echoed back.
+func TestStreamCodecRoundTrip(t *testing.T) {
+	client, _ := echoStreamCodecs(t)
+	echoOnce(t, client, "hello")
+}
+
+// TestStreamCodecClientStreamsFreed is a regression test: after a
+// client-initiated stream completes, its entry in the StreamCodec's streams
+// map must be freed, or a long-lived connection making many calls leaks one
+// streamState (and its buffered channel) per call.
+func TestStreamCodecClientStreamsFreed(t *testing.T) {
+	client, _ := echoStreamCodecs(t)
+	for i := 0; i < 50; i++ {
+		echoOnce(t, client, "hello")
+	}
+	streamCount(t, client, 0)
+}
+
+// TestStreamCodecHandlerPanicReturnsStreamError is a regression test: a
+// handler that panics must fail only its own call with a STREAM_ERROR, not
+// take down the connection's read loop and every other call sharing it.
+func TestStreamCodecHandlerPanicReturnsStreamError(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	server := NewStreamCodec(sconn, DefaultLimits)
+	server.HandleFunc("Test.Echo", func(stream *ServerStream) error {
+		in := new(wire.Header)
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		return stream.SendMsg(&wire.Header{Method: in.Method})
+	})
+	server.HandleFunc("Test.Panic", func(stream *ServerStream) error {
+		panic("boom")
+	})
+	client := NewStreamCodec(cconn, DefaultLimits)
+
+	stream, err := client.NewClientStreamWithRequest(context.Background(), "Test.Panic", &wire.Header{})
+	if err != nil {
+		t.Fatalf("NewClientStreamWithRequest: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	if err := stream.RecvMsg(new(wire.Header)); err == nil {
+		t.Fatal("RecvMsg: got nil error, want the panic reported as a STREAM_ERROR")
+	}
+
+	// The connection itself must still be usable afterwards.
+	echoOnce(t, client, "hello")
+}